@@ -0,0 +1,102 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func (e *Engine) lockedRules(group string) []string {
+	nums := []string{}
+
+	for _, num := range e.GroupRules[group] {
+		if rule := e.Rules[num]; rule != nil && rule.LockOnActive {
+			nums = append(nums, strconv.Itoa(num))
+		}
+	}
+
+	return nums
+}
+
+// activationMark returns the highest instantiation ID present before an
+// action runs, so that the instantiations the action causes can be told
+// apart afterwards. It returns -1 when the rule needs no such bookkeeping.
+func (e *Engine) activationMark(ctx context.Context, tx *sql.Tx, firing *Firing) (int64, error) {
+	rule := e.Rules[firing.RuleIndex]
+
+	if rule == nil || (!rule.NoLoop && len(e.lockedRules(e.IndexToGroup[firing.RuleIndex])) == 0) {
+		return -1, nil
+	}
+
+	var mark int64
+
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(max(ID), 0) FROM instantiations").Scan(&mark); err != nil {
+		return 0, err
+	}
+
+	return mark, nil
+}
+
+// suppressActivations drops the instantiations created by a firing that its
+// rule's NoLoop and its group's LockOnActive attributes forbid.
+func (e *Engine) suppressActivations(ctx context.Context, tx *sql.Tx, firing *Firing, mark int64) error {
+	if mark < 0 {
+		return nil
+	}
+
+	if e.Rules[firing.RuleIndex].NoLoop {
+		resources, err := json.Marshal(firing.Resources)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ID > ? AND ruleNum = ? AND json(resources) = json(?)", mark, firing.RuleIndex, string(resources))
+		if err != nil {
+			return err
+		}
+	}
+
+	if locked := e.lockedRules(e.IndexToGroup[firing.RuleIndex]); len(locked) > 0 {
+		_, err := tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ID > ? AND ruleNum IN (SELECT value FROM json_each(?))", mark, "["+strings.Join(locked, ", ")+"]")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func firingKey(firing *Firing) string {
+	return fmt.Sprintf("%d:%v", firing.RuleIndex, firing.Resources)
+}
+
+// checkFiringLimit enforces MaxFirings. Counts are kept until the agenda
+// next drains, so the limit bounds how often a rule can fire for one tuple
+// within a single cycle of rule activity.
+func (e *Engine) checkFiringLimit(firing *Firing) error {
+	rule := e.Rules[firing.RuleIndex]
+	if rule == nil || rule.MaxFirings <= 0 {
+		return nil
+	}
+
+	if e.firingCounts[firingKey(firing)] >= rule.MaxFirings {
+		return &FiringLimitError{Rule: firing.Rule, Resources: firing.Resources, Limit: rule.MaxFirings}
+	}
+
+	return nil
+}
+
+func (e *Engine) countFiring(firing *Firing) {
+	if rule := e.Rules[firing.RuleIndex]; rule == nil || rule.MaxFirings <= 0 {
+		return
+	}
+
+	if e.firingCounts == nil {
+		e.firingCounts = map[string]int{}
+	}
+
+	e.firingCounts[firingKey(firing)]++
+}
@@ -0,0 +1,83 @@
+package rules
+
+import (
+	"fmt"
+	"testing"
+)
+
+// BenchmarkCrossProduct fires the three-way join from the top-level TestBig
+// rule set, with and without the engine's prepared statement cache.
+func BenchmarkCrossProduct(b *testing.B) {
+	registry := NewRegistry()
+	registry.RuleSet(
+		"cross",
+		Rule(Name("foo"),
+			Conditions(
+				Match("Ball", "ball1", EQ(Field("pattern"), String("stripe"))),
+				Match("Ball", "ball2", AND(AND(EQ(Field("pattern"), String("solid")), EQ(JoinField("ball1", "color"), Field("color"))), GT(Field("value"), JoinField("ball1", "value")))),
+				Match("Gurk", "gurk", EQ(Field("value"), JoinField("ball2", "value")))),
+			Actions(
+				func(c *RuleContext) error {
+					b1value, err := c.GetIntField("ball1", Field("value"), 0)
+					if err != nil {
+						return err
+					}
+
+					b2value, err := c.GetIntField("ball2", Field("value"), 0)
+					if err != nil {
+						return err
+					}
+
+					gvalue, err := c.GetIntField("gurk", Field("value"), 0)
+					if err != nil {
+						return err
+					}
+
+					return c.Add(fmt.Sprintf(`{"kind": "Triple", "metadata": {"namespace": "test", "name": "triple-%d-%d-%d"}, "ball1": %d, "ball2": %d, "gurk": %d}`,
+						b1value, b2value, gvalue, b1value, b2value, gvalue))
+				})))
+
+	resources := []string{}
+
+	for i := 0; i < 30; i++ {
+		for _, pattern := range []string{"stripe", "solid"} {
+			resources = append(resources, fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "%s-%d"}, "pattern": %q, "color": "red", "value": %d}`, pattern, i, pattern, i))
+		}
+
+		resources = append(resources, fmt.Sprintf(`{"kind": "Gurk", "metadata": {"namespace": "test", "name": "gurk-%d"}, "value": %d}`, i, i))
+	}
+
+	for _, cached := range []bool{true, false} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				e, err := registry.NewEngine("", "cross")
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if !cached {
+					if err := e.closeStatements(); err != nil {
+						b.Fatal(err)
+					}
+
+					e.statements = nil
+				}
+
+				if err := e.BulkLoad(resources); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StartTimer()
+
+				if err := e.Run(); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				e.Close()
+			}
+		})
+	}
+}
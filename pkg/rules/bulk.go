@@ -0,0 +1,132 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BulkLoad adds resources like AddResourceStringList, but rather than
+// matching each new resource against working memory as it is inserted, it
+// inserts them all and then matches them with one query per rule. The
+// agenda it leaves is the same as adding the resources one at a time.
+func (e *Engine) BulkLoad(resourceStrs []string) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.beginTx(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	// Resources inserted by the load get IDs above the current maximum.
+	var last int64
+
+	if err := tx.QueryRow("SELECT coalesce(max(ID), 0) FROM resources").Scan(&last); err != nil {
+		return err
+	}
+
+	triggers, err := insertTriggers(tx)
+	if err != nil {
+		return err
+	}
+
+	for name := range triggers {
+		if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER %s", name)); err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare(insertSQL)
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	changed := false
+
+	for _, rstr := range resourceStrs {
+		stored, err := e.storeResource(tx, stmt, rstr, 0)
+		if err != nil {
+			return err
+		}
+
+		changed = changed || stored
+	}
+
+	// Update triggers still fire during the load and may already have
+	// matched new resources; the queries below would double those.
+	if _, err := tx.Exec("DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID > ?)", last); err != nil {
+		return err
+	}
+
+	nums := []int{}
+
+	for num := range e.ruleMatches {
+		nums = append(nums, num)
+	}
+
+	sort.Ints(nums)
+
+	for _, num := range nums {
+		conds := []string{}
+		args := []interface{}{}
+
+		for name := range e.ObjectMaps[num] {
+			conds = append(conds, fmt.Sprintf("%s.ID > ?", name))
+			args = append(args, last)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("%s AND (%s)", e.ruleMatches[num], strings.Join(conds, " OR ")), args...); err != nil {
+			return err
+		}
+	}
+
+	for _, trigger := range triggers {
+		if _, err := tx.Exec(trigger); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if changed {
+		e.notify()
+	}
+
+	return nil
+}
+
+// insertTriggers returns the SQL of the rule triggers that match newly
+// inserted resources, keyed by trigger name.
+func insertTriggers(tx *sql.Tx) (map[string]string, error) {
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE type = 'trigger' AND name GLOB '*_resources_i_[0-9]*'")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	triggers := map[string]string{}
+
+	for rows.Next() {
+		var name, sql string
+
+		if err := rows.Scan(&name, &sql); err != nil {
+			return nil, err
+		}
+
+		triggers[name] = sql
+	}
+
+	return triggers, rows.Err()
+}
@@ -0,0 +1,115 @@
+package rules
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the engine the time. Timer rules, retry backoff and TTLs
+// all read it, so a ManualClock makes them deterministic in tests.
+type Clock interface {
+	Now() time.Time
+	// Timer returns a channel that receives once d has passed and a
+	// function that cancels it.
+	Timer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Timer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+
+	return timer.C, timer.Stop
+}
+
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (mc *ManualClock) Now() time.Time {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	return mc.now
+}
+
+func (mc *ManualClock) Timer(d time.Duration) (<-chan time.Time, func() bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	c := make(chan time.Time, 1)
+
+	if d <= 0 {
+		c <- mc.now
+		return c, func() bool { return false }
+	}
+
+	mc.waiters = append(mc.waiters, clockWaiter{at: mc.now.Add(d), c: c})
+
+	return c, func() bool { return mc.stop(c) }
+}
+
+func (mc *ManualClock) stop(c chan time.Time) bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	for i, w := range mc.waiters {
+		if w.c == c {
+			mc.waiters = append(mc.waiters[:i], mc.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Advance moves the clock forward and fires any timers that are due.
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.now = mc.now.Add(d)
+	waiting := []clockWaiter{}
+
+	for _, w := range mc.waiters {
+		if w.at.After(mc.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+
+		w.c <- mc.now
+	}
+
+	mc.waiters = waiting
+}
+
+func (e *Engine) now() time.Time {
+	if e.Clock == nil {
+		return realClock{}.Now()
+	}
+
+	return e.Clock.Now()
+}
+
+func (e *Engine) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	if e.Clock == nil {
+		return realClock{}.Timer(d)
+	}
+
+	return e.Clock.Timer(d)
+}
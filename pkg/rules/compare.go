@@ -0,0 +1,104 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// IgnoreChanges names dotted paths, such as "metadata.resourceVersion",
+// whose values are not compared when deciding whether an upsert changes a
+// resource.
+func (e *Engine) IgnoreChanges(paths ...string) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	for _, path := range paths {
+		e.ignoredPaths = append(e.ignoredPaths, strings.Split(path, "."))
+	}
+}
+
+func canonicalJSON(data string, ignored [][]string) (string, error) {
+	var val interface{}
+
+	decoder := json.NewDecoder(bytes.NewBufferString(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&val); err != nil {
+		return "", err
+	}
+
+	for _, path := range ignored {
+		removePath(val, path)
+	}
+
+	s, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
+
+func removePath(val interface{}, path []string) {
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		delete(obj, path[0])
+		return
+	}
+
+	removePath(obj[path[0]], path[1:])
+}
+
+// Bumping IGNORED_UPDATES stops the rule update triggers from re-matching a
+// resource whose data changed only in ignored paths.
+const rewriteIgnoredSQL = "UPDATE resources SET DATA = ?, IGNORED_UPDATES = IGNORED_UPDATES + 1 WHERE ID = ?"
+
+// unchanged reports whether the stored resource with the given key already
+// has the same content as data, ignoring key order and the ignored paths. It
+// also returns the ID of the stored resource, if any. When only ignored
+// paths differ, it stores data without re-matching any rule and reports
+// that it rewrote the resource.
+func (e *Engine) unchanged(ctx context.Context, tx *sql.Tx, kind, name, namespace, data string) (int64, bool, bool, error) {
+	var id int64
+	var stored string
+
+	err := tx.QueryRowContext(ctx, "SELECT ID, DATA FROM resources WHERE KIND = ? AND NAME = ? AND NAMESPACE = ?", kind, name, namespace).Scan(&id, &stored)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, false, nil
+	case err != nil:
+		return 0, false, false, err
+	}
+
+	if stored == data {
+		return id, true, false, nil
+	}
+
+	old, err := canonicalJSON(stored, e.ignoredPaths)
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	updated, err := canonicalJSON(data, e.ignoredPaths)
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	if old != updated {
+		return id, false, false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, rewriteIgnoredSQL, data, id); err != nil {
+		return 0, false, false, err
+	}
+
+	return id, true, true, nil
+}
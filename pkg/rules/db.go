@@ -1,14 +1,19 @@
 package rules
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"strings"
+	"sync/atomic"
 
 	_ "github.com/jrryjcksn/go-sqlite3"
 )
 
 var schemaEntries = `
-CREATE TABLE instantiations (ID INTEGER PRIMARY KEY, ruleNum INTEGER NOT NULL, priority INTEGER NOT NULL DEFAULT 0, timestamp INTEGER, active BOOL NOT NULL DEFAULT true, resources JSON NOT NULL)
+CREATE TABLE instantiations (ID INTEGER PRIMARY KEY, ruleNum INTEGER NOT NULL, priority INTEGER NOT NULL DEFAULT 0, timestamp INTEGER, active BOOL NOT NULL DEFAULT true, attempts INTEGER NOT NULL DEFAULT 0, retry_at INTEGER, scheduled BOOL NOT NULL DEFAULT false, rule_id TEXT, resources JSON NOT NULL)
+CREATE TRIGGER instantiation_rule_TRIGGER AFTER INSERT ON instantiations WHEN NEW.rule_id IS NULL BEGIN UPDATE instantiations SET rule_id = (SELECT identity FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
+CREATE TRIGGER instantiation_timer_TRIGGER AFTER INSERT ON instantiations WHEN NOT NEW.scheduled AND EXISTS (SELECT 1 FROM rules WHERE ruleNum = NEW.ruleNum AND (after > 0 OR deadline_path IS NOT NULL)) BEGIN UPDATE instantiations SET scheduled = true, retry_at = (SELECT CASE WHEN deadline_path IS NULL THEN (SELECT now FROM clock) + after ELSE coalesce((SELECT CAST(strftime('%s', json_extract(DATA, rules.deadline_path)) AS INTEGER) * 1000000000 FROM resources WHERE ID = json_extract(NEW.resources, '$[' || rules.deadline_index || ']')), 9223372036854775807) END FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
 CREATE TRIGGER instantiation_expansion_TRIGGER AFTER INSERT ON instantiations BEGIN UPDATE instantiations SET timestamp = time('now', 'unixepoch') WHERE ID = NEW.ID; END
 CREATE TRIGGER instantiation_connection_TRIGGER AFTER INSERT ON instantiations BEGIN INSERT INTO resource_instantiations SELECT value, NEW.ID FROM json_each(NEW.resources); END
 CREATE TRIGGER instantiation_delete_TRIGGER AFTER DELETE ON instantiations BEGIN DELETE FROM resource_instantiations WHERE instantiation_ID = OLD.ID; END
@@ -17,53 +22,190 @@ CREATE TABLE resource_instantiations (resource_ID INTEGER NOT NULL, instantiatio
 CREATE INDEX resource_instantiations_INDEX ON resource_instantiations (resource_ID)
 CREATE INDEX instantiation_resources_INDEX ON resource_instantiations (instantiation_ID, resource_ID)
 
-CREATE TABLE resources (ID INTEGER PRIMARY KEY, KIND TEXT NOT NULL, NAME TEXT NOT NULL DEFAULT "", NAMESPACE TEXT NOT NULL DEFAULT "", DATA JSON NOT NULL)
+CREATE TABLE justifications (ID INTEGER PRIMARY KEY, resource_ID INTEGER NOT NULL, ruleNum INTEGER NOT NULL, rule_id TEXT, resources JSON NOT NULL)
+CREATE TRIGGER justification_rule_TRIGGER AFTER INSERT ON justifications WHEN NEW.rule_id IS NULL BEGIN UPDATE justifications SET rule_id = (SELECT identity FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
+CREATE INDEX justification_resource_INDEX ON justifications (resource_ID)
+CREATE TRIGGER justification_connection_TRIGGER AFTER INSERT ON justifications BEGIN INSERT INTO resource_justifications SELECT value, NEW.ID FROM json_each(NEW.resources); END
+CREATE TRIGGER justification_delete_TRIGGER AFTER DELETE ON justifications BEGIN DELETE FROM resource_justifications WHERE justification_ID = OLD.ID; DELETE FROM resources WHERE ID = OLD.resource_ID AND NOT STATED AND NOT EXISTS (SELECT 1 FROM justifications WHERE resource_ID = OLD.resource_ID); END
+CREATE TABLE resource_justifications (resource_ID INTEGER NOT NULL, justification_ID INTEGER NOT NULL)
+CREATE INDEX resource_justifications_INDEX ON resource_justifications (resource_ID)
+CREATE INDEX justification_resources_INDEX ON resource_justifications (justification_ID, resource_ID)
+
+CREATE TABLE resources (ID INTEGER PRIMARY KEY, KIND TEXT NOT NULL, NAME TEXT NOT NULL DEFAULT "", NAMESPACE TEXT NOT NULL DEFAULT "", DATA JSON NOT NULL, EXPIRES_AT INTEGER, EXPIRY_EVENT BOOL NOT NULL DEFAULT false, IGNORED_UPDATES INTEGER NOT NULL DEFAULT 0, STATED BOOL NOT NULL DEFAULT true)
+CREATE INDEX resource_expiry_INDEX ON resources (EXPIRES_AT) WHERE EXPIRES_AT IS NOT NULL
 CREATE UNIQUE INDEX unique_resource_INDEX ON resources (KIND, NAME, NAMESPACE)
 CREATE INDEX namespace_resource_INDEX ON resources (NAMESPACE)
-CREATE TRIGGER resource_upsert_TRIGGER BEFORE UPDATE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = NEW.ID); DELETE FROM resource_instantiations WHERE resource_ID = NEW.ID; END
-CREATE TRIGGER resource_delete_TRIGGER AFTER DELETE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = OLD.ID); DELETE FROM resource_instantiations WHERE resource_ID = OLD.ID; END
+CREATE TRIGGER resource_delete_TRIGGER AFTER DELETE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = OLD.ID); DELETE FROM resource_instantiations WHERE resource_ID = OLD.ID; DELETE FROM justifications WHERE ID IN (SELECT justification_ID FROM resource_justifications WHERE resource_ID = OLD.ID); DELETE FROM justifications WHERE resource_ID = OLD.ID; END
+
+CREATE TABLE dead_letters (ID INTEGER PRIMARY KEY, ruleNum INTEGER NOT NULL, resources JSON NOT NULL, attempts INTEGER NOT NULL, error TEXT NOT NULL, timestamp INTEGER NOT NULL)
 
 CREATE TABLE configuration (name TEXT PRIMARY KEY, val)
+
+CREATE TABLE rules (ruleNum INTEGER PRIMARY KEY, identity TEXT NOT NULL, after INTEGER NOT NULL DEFAULT 0, deadline_path TEXT, deadline_index INTEGER)
+CREATE TABLE clock (now INTEGER NOT NULL)
+INSERT INTO clock (now) VALUES (0)
+
+CREATE TABLE outbox (ID INTEGER PRIMARY KEY AUTOINCREMENT, idempotency_key TEXT, kind TEXT NOT NULL, payload JSON NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, error TEXT, delivered_at INTEGER)
+CREATE UNIQUE INDEX outbox_key_INDEX ON outbox (idempotency_key)
 `
 
-func getDB(connection string) (*sql.DB, error) {
+const schemaVersion = 8
+
+// migrations[v] takes a database from version v to v+1.
+var migrations = map[int]string{
+	1: `
+ALTER TABLE instantiations ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0
+ALTER TABLE instantiations ADD COLUMN retry_at INTEGER
+ALTER TABLE instantiations ADD COLUMN scheduled BOOL NOT NULL DEFAULT false
+
+CREATE TABLE justifications (ID INTEGER PRIMARY KEY, resource_ID INTEGER NOT NULL, ruleNum INTEGER NOT NULL, resources JSON NOT NULL)
+CREATE INDEX justification_resource_INDEX ON justifications (resource_ID)
+CREATE TRIGGER justification_connection_TRIGGER AFTER INSERT ON justifications BEGIN INSERT INTO resource_justifications SELECT value, NEW.ID FROM json_each(NEW.resources); END
+CREATE TRIGGER justification_delete_TRIGGER AFTER DELETE ON justifications BEGIN DELETE FROM resource_justifications WHERE justification_ID = OLD.ID; DELETE FROM resources WHERE ID = OLD.resource_ID AND NOT EXISTS (SELECT 1 FROM justifications WHERE resource_ID = OLD.resource_ID); END
+CREATE TABLE resource_justifications (resource_ID INTEGER NOT NULL, justification_ID INTEGER NOT NULL)
+CREATE INDEX resource_justifications_INDEX ON resource_justifications (resource_ID)
+CREATE INDEX justification_resources_INDEX ON resource_justifications (justification_ID, resource_ID)
+
+ALTER TABLE resources ADD COLUMN EXPIRES_AT INTEGER
+CREATE INDEX resource_expiry_INDEX ON resources (EXPIRES_AT) WHERE EXPIRES_AT IS NOT NULL
+DROP TRIGGER IF EXISTS resource_upsert_TRIGGER
+DROP TRIGGER IF EXISTS resource_delete_TRIGGER
+CREATE TRIGGER resource_delete_TRIGGER AFTER DELETE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = OLD.ID); DELETE FROM resource_instantiations WHERE resource_ID = OLD.ID; DELETE FROM justifications WHERE ID IN (SELECT justification_ID FROM resource_justifications WHERE resource_ID = OLD.ID); DELETE FROM justifications WHERE resource_ID = OLD.ID; END
+
+CREATE TABLE dead_letters (ID INTEGER PRIMARY KEY, ruleNum INTEGER NOT NULL, resources JSON NOT NULL, attempts INTEGER NOT NULL, error TEXT NOT NULL, timestamp INTEGER NOT NULL)
+
+CREATE TABLE outbox (ID INTEGER PRIMARY KEY AUTOINCREMENT, idempotency_key TEXT, kind TEXT NOT NULL, payload JSON NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, error TEXT)
+CREATE UNIQUE INDEX outbox_key_INDEX ON outbox (idempotency_key)
+`,
+	2: `
+CREATE TABLE rules (ruleNum INTEGER PRIMARY KEY, identity TEXT NOT NULL)
+ALTER TABLE instantiations ADD COLUMN rule_id TEXT
+CREATE TRIGGER instantiation_rule_TRIGGER AFTER INSERT ON instantiations WHEN NEW.rule_id IS NULL BEGIN UPDATE instantiations SET rule_id = (SELECT identity FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
+ALTER TABLE justifications ADD COLUMN rule_id TEXT
+CREATE TRIGGER justification_rule_TRIGGER AFTER INSERT ON justifications WHEN NEW.rule_id IS NULL BEGIN UPDATE justifications SET rule_id = (SELECT identity FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
+`,
+	3: `
+ALTER TABLE outbox ADD COLUMN delivered_at INTEGER
+`,
+	4: `
+ALTER TABLE rules ADD COLUMN after INTEGER NOT NULL DEFAULT 0
+ALTER TABLE rules ADD COLUMN deadline_path TEXT
+ALTER TABLE rules ADD COLUMN deadline_index INTEGER
+CREATE TABLE clock (now INTEGER NOT NULL)
+INSERT INTO clock (now) VALUES (0)
+CREATE TRIGGER instantiation_timer_TRIGGER AFTER INSERT ON instantiations WHEN NOT NEW.scheduled AND EXISTS (SELECT 1 FROM rules WHERE ruleNum = NEW.ruleNum AND (after > 0 OR deadline_path IS NOT NULL)) BEGIN UPDATE instantiations SET scheduled = true, retry_at = (SELECT CASE WHEN deadline_path IS NULL THEN (SELECT now FROM clock) + after ELSE coalesce((SELECT CAST(strftime('%s', json_extract(DATA, rules.deadline_path)) AS INTEGER) * 1000000000 FROM resources WHERE ID = json_extract(NEW.resources, '$[' || rules.deadline_index || ']')), 9223372036854775807) END FROM rules WHERE ruleNum = NEW.ruleNum) WHERE ID = NEW.ID; END
+`,
+	5: `
+ALTER TABLE resources ADD COLUMN EXPIRY_EVENT BOOL NOT NULL DEFAULT false
+`,
+	6: `
+ALTER TABLE resources ADD COLUMN IGNORED_UPDATES INTEGER NOT NULL DEFAULT 0
+`,
+	7: `
+ALTER TABLE resources ADD COLUMN STATED BOOL NOT NULL DEFAULT true
+UPDATE resources SET STATED = false WHERE ID IN (SELECT resource_ID FROM justifications)
+DROP TRIGGER justification_delete_TRIGGER
+CREATE TRIGGER justification_delete_TRIGGER AFTER DELETE ON justifications BEGIN DELETE FROM resource_justifications WHERE justification_ID = OLD.ID; DELETE FROM resources WHERE ID = OLD.resource_ID AND NOT STATED AND NOT EXISTS (SELECT 1 FROM justifications WHERE resource_ID = OLD.resource_ID); END
+`,
+}
+
+var memoryDBCount uint64
+
+// getDB opens the database and returns it with a connection that the
+// caller keeps open until the database is closed. database/sql drops the
+// connection of a transaction whose context is cancelled, and an in-memory
+// database disappears with its last connection.
+func getDB(connection string) (*sql.DB, *sql.Conn, error) {
+	// Each engine without a path gets its own in-memory database. The cache
+	// is shared only between the connections of that engine's pool.
 	if connection == "" {
-		connection = "file::memory:?cache=shared"
-		//     connection = "file::memory:"
+		connection = fmt.Sprintf("file:gorules-%d?mode=memory&cache=shared", atomic.AddUint64(&memoryDBCount, 1))
+	}
+
+	// Retracting a logical resource can cascade through the resource and
+	// justification triggers more than once.
+	if strings.Contains(connection, "?") {
+		connection += "&_recursive_triggers=1"
+	} else {
+		connection += "?_recursive_triggers=1"
 	}
 
 	database, err := sql.Open("sqlite3", connection)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	for _, entry := range strings.Split(schemaEntries, "\n") {
-		if entry == "" {
-			continue
+	anchor, err := database.Conn(context.Background())
+	if err != nil {
+		database.Close()
+		return nil, nil, err
+	}
+
+	if err := migrate(database); err != nil {
+		anchor.Close()
+		database.Close()
+		return nil, nil, err
+	}
+
+	return database, anchor, nil
+}
+
+func schemaStatements(schema string) []string {
+	stmts := []string{}
+
+	for _, entry := range strings.Split(schema, "\n") {
+		if entry != "" {
+			stmts = append(stmts, entry)
 		}
+	}
 
-		tx, err := database.Begin()
-		if err != nil {
-			return nil, err
+	return stmts
+}
+
+// migrate creates the schema in a new database or brings an existing one up
+// to schemaVersion. Databases from before versioning are at version 1.
+func migrate(database *sql.DB) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	var tables int
+
+	if err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'resources'").Scan(&tables); err != nil {
+		return err
+	}
+
+	stmts := []string{}
+
+	if tables == 0 {
+		stmts = schemaStatements(schemaEntries)
+	} else {
+		version := 1
+
+		err := tx.QueryRow("SELECT val FROM configuration WHERE name = 'schema_version'").Scan(&version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
 		}
 
-		s, err := tx.Prepare(entry)
-		if err != nil {
-			return nil, err
+		if version > schemaVersion {
+			return fmt.Errorf("%w: database is at version %d, engine supports %d", ErrSchemaVersion, version, schemaVersion)
 		}
 
-		// defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
-		_, err = s.Exec()
-		if err != nil {
-			return nil, err
+		for ; version < schemaVersion; version++ {
+			stmts = append(stmts, schemaStatements(migrations[version])...)
 		}
+	}
 
-		s.Close()
+	stmts = append(stmts, fmt.Sprintf("INSERT INTO configuration (name, val) VALUES ('schema_version', %d) ON CONFLICT (name) DO UPDATE SET val = excluded.val", schemaVersion))
 
-		if err := tx.Commit(); err != nil {
-			return nil, err
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
 		}
 	}
 
-	return database, nil
+	return tx.Commit()
 }
@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+func disabledTrigger(ruleNum int) string {
+	return fmt.Sprintf("rule_disabled_TRIGGER_%d", ruleNum)
+}
+
+func disabledKey(name string) string {
+	return "disabled_rule:" + name
+}
+
+// disableSQL parks new instantiations of a rule as they are created.
+func disableSQL(ruleNum int) string {
+	return fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS %s AFTER INSERT ON instantiations WHEN NEW.ruleNum = %d BEGIN UPDATE instantiations SET active = false WHERE ID = NEW.ID; END", disabledTrigger(ruleNum), ruleNum)
+}
+
+func (e *Engine) ruleDisabled(name string) (bool, error) {
+	var val bool
+
+	err := e.DB.QueryRow("SELECT val FROM configuration WHERE name = ?", disabledKey(name)).Scan(&val)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return val, nil
+}
+
+// DisableRule stops a rule from firing. Its instantiations stay on the
+// agenda, inactive, until the rule is enabled again. The setting is kept in
+// the database and applies to any rule of that name installed later.
+func (e *Engine) DisableRule(name string) (err error) {
+	defer wrapStorageError(&err)
+
+	return e.setRuleEnabled(name, false)
+}
+
+func (e *Engine) EnableRule(name string) (err error) {
+	defer wrapStorageError(&err)
+
+	return e.setRuleEnabled(name, true)
+}
+
+func (e *Engine) RuleEnabled(name string) (_ bool, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	disabled, err := e.ruleDisabled(name)
+
+	return !disabled, err
+}
+
+func (e *Engine) setRuleEnabled(name string, enabled bool) error {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	// Rules of the same name in different rule sets share the setting.
+	ruleNums := []int{}
+
+	for num, ruleName := range e.IndexToRuleName {
+		if ruleName == name {
+			ruleNums = append(ruleNums, num)
+		}
+	}
+
+	if len(ruleNums) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchRule, name)
+	}
+
+	sort.Ints(ruleNums)
+
+	stmts := []string{}
+
+	for _, ruleNum := range ruleNums {
+		stmts = append(stmts, fmt.Sprintf("UPDATE instantiations SET active = %t WHERE ruleNum = %d", enabled, ruleNum))
+
+		if enabled {
+			stmts = append(stmts, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", disabledTrigger(ruleNum)))
+		} else {
+			stmts = append(stmts, disableSQL(ruleNum))
+		}
+	}
+
+	if enabled {
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM configuration WHERE name = %s", quoteSQL(disabledKey(name))))
+	} else {
+		stmts = append(stmts, fmt.Sprintf("INSERT INTO configuration (name, val) VALUES (%s, true) ON CONFLICT (name) DO UPDATE SET val = true", quoteSQL(disabledKey(name))))
+	}
+
+	if err := e.ApplyInTransaction(stmts); err != nil {
+		return err
+	}
+
+	if enabled {
+		e.notify()
+	}
+
+	return nil
+}
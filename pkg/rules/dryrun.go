@@ -0,0 +1,219 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+type ResourceChange struct {
+	Op        string // "added", "modified" or "deleted"
+	Kind      string
+	Name      string
+	Namespace string
+	Before    json.RawMessage
+	After     json.RawMessage
+}
+
+type DryRunFiring struct {
+	Firing
+	Changes []ResourceChange
+	Err     error
+}
+
+type DryRunReport struct {
+	Firings []DryRunFiring
+	Halted  bool
+}
+
+// The change log only exists inside the dry run's transaction.
+var dryRunSchema = []string{
+	`CREATE TABLE dry_run_changes (seq INTEGER PRIMARY KEY, op TEXT NOT NULL, kind TEXT NOT NULL, name TEXT NOT NULL, namespace TEXT NOT NULL, before JSON, after JSON)`,
+	`CREATE TRIGGER dry_run_insert_TRIGGER AFTER INSERT ON resources BEGIN INSERT INTO dry_run_changes (op, kind, name, namespace, after) VALUES ('added', NEW.KIND, NEW.NAME, NEW.NAMESPACE, NEW.DATA); END`,
+	`CREATE TRIGGER dry_run_update_TRIGGER AFTER UPDATE OF DATA ON resources BEGIN INSERT INTO dry_run_changes (op, kind, name, namespace, before, after) VALUES ('modified', NEW.KIND, NEW.NAME, NEW.NAMESPACE, OLD.DATA, NEW.DATA); END`,
+	`CREATE TRIGGER dry_run_delete_TRIGGER AFTER DELETE ON resources BEGIN INSERT INTO dry_run_changes (op, kind, name, namespace, before) VALUES ('deleted', OLD.KIND, OLD.NAME, OLD.NAMESPACE, OLD.DATA); END`,
+}
+
+// DryRun fires the agenda as Run would, inside a single transaction that is
+// always rolled back, and reports what each firing did. Failing actions are
+// reported and skipped rather than retried, and effects are not dispatched.
+// An instantiation over its rule's MaxFirings is reported with a
+// FiringLimitError. A rule set that never quiesces runs until the context
+// is done.
+func (e *Engine) DryRun(ctx context.Context) (_ *DryRunReport, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	focus, counts := e.focus, e.firingCounts
+	e.focus = append([]string{}, focus...)
+	e.firingCounts = map[string]int{}
+
+	for key, count := range counts {
+		e.firingCounts[key] = count
+	}
+
+	defer func() { e.focus, e.firingCounts = focus, counts }()
+
+	tx, err := e.beginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	for _, stmt := range dryRunSchema {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &DryRunReport{}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		firing, err := e.nextInstantiation(ctx, tx)
+		if err != nil || firing == nil {
+			return report, err
+		}
+
+		// Expiring resources is not part of the firing.
+		if _, err := tx.ExecContext(ctx, "DELETE FROM dry_run_changes"); err != nil {
+			return report, err
+		}
+
+		if limitErr := e.checkFiringLimit(firing); limitErr != nil {
+			if err := e.deadLetter(ctx, tx, firing, limitErr); err != nil {
+				return report, err
+			}
+
+			report.Firings = append(report.Firings, DryRunFiring{Firing: *firing, Changes: []ResourceChange{}, Err: limitErr})
+			continue
+		}
+
+		result, halted, err := e.dryFire(ctx, tx, firing)
+		if err != nil {
+			return report, err
+		}
+
+		if result.Err == nil {
+			e.countFiring(firing)
+		}
+
+		report.Firings = append(report.Firings, *result)
+
+		if halted {
+			report.Halted = true
+			return report, nil
+		}
+	}
+}
+
+func (e *Engine) dryFire(ctx context.Context, tx *sql.Tx, firing *Firing) (*DryRunFiring, bool, error) {
+	result := &DryRunFiring{Firing: *firing}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT dry_run_firing"); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ID = ?", firing.InstantiationID); err != nil {
+		return nil, false, err
+	}
+
+	mark, err := e.activationMark(ctx, tx, firing)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rc := e.newRuleContext(ctx, tx, firing)
+
+	if err := e.CallAction(rc, e.RuleFunctions[firing.RuleIndex]); err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		result.Err = &ActionError{Rule: firing.Rule, InstantiationID: firing.InstantiationID, Resources: firing.Resources, Err: err}
+
+		// Undo the action but keep the instantiation off the agenda.
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO dry_run_firing"); err != nil {
+			return nil, false, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ID = ?", firing.InstantiationID); err != nil {
+			return nil, false, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "RELEASE dry_run_firing"); err != nil {
+			return nil, false, err
+		}
+
+		return result, false, nil
+	}
+
+	if err := e.suppressActivations(ctx, tx, firing, mark); err != nil {
+		return nil, false, err
+	}
+
+	if err := e.reschedule(ctx, tx, firing); err != nil {
+		return nil, false, err
+	}
+
+	if result.Changes, err = dryRunChanges(ctx, tx); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "RELEASE dry_run_firing"); err != nil {
+		return nil, false, err
+	}
+
+	for _, group := range rc.focus {
+		e.pushFocus(group)
+	}
+
+	return result, rc.halted, nil
+}
+
+func dryRunChanges(ctx context.Context, tx *sql.Tx) ([]ResourceChange, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT op, kind, name, namespace, before, after FROM dry_run_changes ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ResourceChange{}
+
+	for rows.Next() {
+		var change ResourceChange
+		var before, after sql.NullString
+
+		if err := rows.Scan(&change.Op, &change.Kind, &change.Name, &change.Namespace, &before, &after); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if before.Valid {
+			change.Before = json.RawMessage(before.String)
+		}
+
+		if after.Valid {
+			change.After = json.RawMessage(after.String)
+		}
+
+		changes = append(changes, change)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM dry_run_changes"); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
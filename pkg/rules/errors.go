@@ -0,0 +1,92 @@
+package rules
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	sqlite3 "github.com/jrryjcksn/go-sqlite3"
+)
+
+var (
+	ErrUnknownObject  = errors.New("unknown object")
+	ErrBadPath        = errors.New("bad path")
+	ErrNoSuchRuleSet  = errors.New("no such ruleset")
+	ErrNoSuchRule     = errors.New("no such rule")
+	ErrSchemaVersion  = errors.New("unsupported schema version")
+	ErrEffectKey      = errors.New("effect key already used for a different effect")
+	ErrNotServing     = errors.New("engine is not serving")
+	ErrStorage        = errors.New("storage error")
+	ErrResourceType   = errors.New("unsupported resource type")
+	ErrDeletedObject  = errors.New("invalid deleted object")
+	ErrSnapshotFormat = errors.New("bad snapshot")
+)
+
+// An ActionError reports that a rule's action failed for an instantiation.
+// Errors that do not come wrapped in an ActionError came from the engine or
+// its database.
+type ActionError struct {
+	Rule            string
+	InstantiationID int
+	Resources       []int
+	Err             error
+}
+
+func (ae *ActionError) Error() string {
+	return fmt.Sprintf("rule %s failed for resources %v: %v", ae.Rule, ae.Resources, ae.Err)
+}
+
+func (ae *ActionError) Unwrap() error {
+	return ae.Err
+}
+
+// A FiringLimitError reports that a rule reached its MaxFirings limit for a
+// tuple of resources. The instantiation is moved to the dead letter table.
+type FiringLimitError struct {
+	Rule      string
+	Resources []int
+	Limit     int
+}
+
+func (fe *FiringLimitError) Error() string {
+	return fmt.Sprintf("rule %s exceeded %d firings for resources %v", fe.Rule, fe.Limit, fe.Resources)
+}
+
+// A StorageError reports that the database failed. It matches ErrStorage
+// with errors.Is and unwraps to the driver's error.
+type StorageError struct {
+	Err error
+}
+
+func (se *StorageError) Error() string {
+	return se.Err.Error()
+}
+
+func (se *StorageError) Unwrap() error {
+	return se.Err
+}
+
+func (se *StorageError) Is(target error) bool {
+	return target == ErrStorage
+}
+
+// wrapStorageError turns an error from the database into a StorageError.
+// Errors raised by the engine or by actions are left as they are.
+func wrapStorageError(err *error) {
+	var ae *ActionError
+	var driverErr sqlite3.Error
+
+	switch {
+	case *err == nil, errors.As(*err, &ae), errors.Is(*err, ErrStorage):
+	case errors.As(*err, &driverErr), errors.Is(*err, sql.ErrConnDone), errors.Is(*err, sql.ErrTxDone):
+		*err = &StorageError{Err: *err}
+	}
+}
+
+func unknownObject(name string) error {
+	return fmt.Errorf("%w: %s", ErrUnknownObject, name)
+}
+
+func badPath(path []string) error {
+	return fmt.Errorf("%w: %s", ErrBadPath, path)
+}
@@ -1,11 +1,16 @@
 package rules
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type NumericComparisonOperator string
@@ -38,7 +43,6 @@ const (
 var (
 	emptyTables = map[string]string{}
 	emptyRefs   = map[string]bool{}
-	rulesets    = map[string]*RuleSetVal{}
 )
 
 type RuleSetVal struct {
@@ -53,13 +57,13 @@ type Table struct {
 type ActionFunc func(rc *RuleContext) error
 
 type InstantiationData struct {
-	Names     []string
-	Kinds     []string
-	RuleIndex int
-	Priority  int
-	Tables    map[string]string
-	Refs      map[string]bool
-	//	FieldChecks    map[string]map[string]bool
+	Names       []string
+	Kinds       []string
+	RuleIndex   int
+	Priority    int
+	Tables      map[string]string
+	Refs        map[string]bool
+	FieldChecks map[string]map[string]bool
 	ObjectMap   map[string]int
 	Queries     map[string]Queries
 	Indexes     map[string]map[string]bool
@@ -67,7 +71,7 @@ type InstantiationData struct {
 }
 
 type Queries struct {
-	Insert, Update string
+	Insert, Update, Delete string
 }
 
 type Kind string
@@ -90,296 +94,698 @@ type Namespaced interface {
 type KeyFunc func(jstr interface{}) (string, string, string, error)
 
 func defaultKeyFunc(jstr interface{}) (string, string, string, error) {
-	var kind, name, namespace string
-
-	kindObj, ok := jstr.(Kinded)
-	if ok {
-		kind = kindObj.Kind()
-		name = kindObj.Name()
-
-		nsObj, ok := jstr.(Namespaced)
-		if ok {
-			namespace = nsObj.Namespace()
-		}
-
-		return kind, name, namespace, nil
-	}
-
 	var res map[string]interface{}
 
 	switch v := jstr.(type) {
+	case Kinded:
+		return kindedKey(v)
 	case string:
 		if err := json.Unmarshal([]byte(v), &res); err != nil {
 			return "", "", "", err
 		}
-
+	case map[string]interface{}:
+		res = v
 	default:
-		res = jstr.(map[string]interface{})
+		return "", "", "", fmt.Errorf("%w: %T", ErrResourceType, jstr)
 	}
 
-	return res["kind"].(string), res["metadata"].(map[string]interface{})["name"].(string), res["metadata"].(map[string]interface{})["namespace"].(string), nil
+	return objectKey(res)
 }
 
 func KubernetesKeyFunc(jstr interface{}) (string, string, string, error) {
 	var res map[string]interface{}
 
 	switch v := jstr.(type) {
+	case Kinded:
+		return kindedKey(v)
 	case string:
 		if err := json.Unmarshal([]byte(v), &res); err != nil {
 			return "", "", "", err
 		}
-
+	case map[string]interface{}:
+		res = v
 	default:
-		res = jstr.(map[string]interface{})
+		return "", "", "", fmt.Errorf("%w: %T", ErrResourceType, jstr)
+	}
+
+	return objectKey(res)
+}
+
+// kindedKey reads the key of a struct that names itself.
+func kindedKey(obj Kinded) (string, string, string, error) {
+	var namespace string
+
+	if nsObj, ok := obj.(Namespaced); ok {
+		namespace = nsObj.Namespace()
+	}
+
+	return obj.Kind(), obj.Name(), namespace, nil
+}
+
+// objectKey reads the kind, name and namespace of a decoded Kubernetes style
+// object. The namespace may be absent.
+func objectKey(res map[string]interface{}) (string, string, string, error) {
+	kind, ok := res["kind"].(string)
+	if !ok {
+		return "", "", "", badPath([]string{"kind"})
+	}
+
+	metadata, ok := res["metadata"].(map[string]interface{})
+	if !ok {
+		return "", "", "", badPath([]string{"metadata"})
+	}
+
+	name, ok := metadata["name"].(string)
+	if !ok {
+		return "", "", "", badPath([]string{"metadata", "name"})
 	}
 
-	return res["kind"].(string), res["metadata"].(map[string]interface{})["name"].(string), res["metadata"].(map[string]interface{})["namespace"].(string), nil
+	namespace, _ := metadata["namespace"].(string)
+
+	return kind, name, namespace, nil
 }
 
 type Engine struct {
 	DB              *sql.DB
+	anchor          *sql.Conn
+	Registry        *Registry
 	RuleNameToIndex map[string]int
 	IndexToRuleName map[int]string
 	RuleSets        []*RuleSetVal
 	RuleCount       int
 	RuleFunctions   map[int]ActionFunc
 	ObjectMaps      map[int]map[string]int
+	GroupRules      map[string][]int
+	IndexToGroup    map[int]string
+	Rules           map[int]*RuleVal
 	KeyFunction     KeyFunc
+	Clock           Clock
+	focus           []string
+	dispatcher      DispatchFunc
+	dispatchErrors  func(error)
+	emitted         bool
+	txLock          sync.Mutex
+	stmtLock        sync.Mutex
+	statements      map[string]*sql.Stmt
+	serveLock       sync.Mutex
+	wake            chan struct{}
+	idle            chan struct{}
+	serving         chan struct{}
+	notified        uint64
+	firingCounts    map[string]int
+	ignoredPaths    [][]string
+	kindTTLs        map[string]time.Duration
+	ruleSetFirst    map[*RuleSetVal]int
+	ruleTriggers    map[int][]string
+	ruleMatches     map[int]string
+	ruleIdentities  map[int]string
+	staleTriggers   map[string]string
+	staleRules      map[string]bool
+	ruleIndexes     map[int][]string
+	indexRefs       map[string]int
+	ErrorPolicy     ErrorPolicy
 }
 
 func (q Queries) AddSQL(allQueries []string) []string {
-	return append(allQueries, q.Insert, q.Update)
+	for _, query := range []string{q.Delete, q.Insert, q.Update} {
+		if query != "" {
+			allQueries = append(allQueries, query)
+		}
+	}
+
+	return allQueries
 }
 
 func NewEngine(path string, rulesets ...string) (*Engine, error) {
-	db, err := getDB(path)
+	return DefaultRegistry.NewEngine(path, rulesets...)
+}
+
+func NewK8sEngine(path string, rulesets ...string) (*Engine, error) {
+	return DefaultRegistry.NewK8sEngine(path, rulesets...)
+}
+
+func newEngine(path string, registry *Registry, keyfunc KeyFunc, rulesets []string) (_ *Engine, err error) {
+	defer wrapStorageError(&err)
+
+	db, anchor, err := getDB(path)
 	if err != nil {
 		return nil, err
 	}
 
 	eng := &Engine{
 		DB:              db,
-		KeyFunction:     defaultKeyFunc,
+		anchor:          anchor,
+		Registry:        registry,
+		KeyFunction:     keyfunc,
+		ErrorPolicy:     DefaultErrorPolicy,
 		RuleFunctions:   map[int]ActionFunc{},
 		RuleSets:        []*RuleSetVal{},
 		ObjectMaps:      map[int]map[string]int{},
+		GroupRules:      map[string][]int{},
+		IndexToGroup:    map[int]string{},
+		Rules:           map[int]*RuleVal{},
 		RuleNameToIndex: map[string]int{},
 		IndexToRuleName: map[int]string{},
+		ruleSetFirst:    map[*RuleSetVal]int{},
+		ruleTriggers:    map[int][]string{},
+		ruleMatches:     map[int]string{},
+		ruleIdentities:  map[int]string{},
+		statements:      map[string]*sql.Stmt{},
+		kindTTLs:        map[string]time.Duration{},
+		ruleIndexes:     map[int][]string{},
+		indexRefs:       map[string]int{},
+		wake:            make(chan struct{}, 1),
+	}
+
+	if err := eng.loadStaleRules(); err != nil {
+		eng.closeDB()
+		return nil, err
 	}
 
 	for _, rsname := range rulesets {
 		if err := eng.AddRuleSet(rsname); err != nil {
+			eng.closeDB()
 			return nil, err
 		}
 	}
 
-	return eng, nil
-}
+	if err := eng.dropStaleRules(); err != nil {
+		eng.closeDB()
+		return nil, err
+	}
 
-func NewK8sEngine(path string, rulesets ...string) (*Engine, error) {
-	db, err := getDB(path)
-	if err != nil {
+	if err := eng.prepareStatements(); err != nil {
+		eng.Close()
 		return nil, err
 	}
 
-	eng := &Engine{
-		DB:              db,
-		KeyFunction:     KubernetesKeyFunc,
-		RuleFunctions:   map[int]ActionFunc{},
-		RuleSets:        []*RuleSetVal{},
-		ObjectMaps:      map[int]map[string]int{},
-		RuleNameToIndex: map[string]int{},
-		IndexToRuleName: map[int]string{},
+	return eng, nil
+}
+
+func (e *Engine) Close() (err error) {
+	defer wrapStorageError(&err)
+
+	if err := e.closeStatements(); err != nil {
+		e.closeDB()
+		return err
 	}
 
-	for _, rsname := range rulesets {
-		if err := eng.AddRuleSet(rsname); err != nil {
-			return nil, err
-		}
+	return e.closeDB()
+}
+
+func (e *Engine) closeDB() error {
+	if e.anchor != nil {
+		e.anchor.Close()
 	}
 
-	return eng, nil
+	return e.DB.Close()
 }
 
 func (e *Engine) AddRuleSet(name string) error {
-	rs, ok := rulesets[name]
+	rs, ok := e.Registry.Lookup(name)
 	if !ok {
-		return fmt.Errorf("no such ruleset: %s", name)
+		return fmt.Errorf("%w: %s", ErrNoSuchRuleSet, name)
 	}
 
-	e.RuleSets = append(e.RuleSets, rs)
+	return e.AddRuleSetVal(rs)
+}
 
-	allSQL := []string{}
-	ruleID := e.RuleCount
+func (e *Engine) AddRuleSetVal(rs *RuleSetVal) (err error) {
+	defer wrapStorageError(&err)
 
-	for _, rule := range rs.Rules {
-		idata := &InstantiationData{
-			Names:     []string{},
-			RuleIndex: ruleID,
-			Tables:    map[string]string{},
-			Refs:      map[string]bool{},
-			Queries:   map[string]Queries{},
-			Indexes:   map[string]map[string]bool{},
-		}
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
 
-		if _, err := rule.Instantiate(idata, 0); err != nil {
-			return err
-		}
+	compiled, err := e.compileRuleSet(rs, nil)
+	if err != nil {
+		return err
+	}
 
-		for key, val := range idata.Queries {
-			if key != "" {
-				allSQL = val.AddSQL(allSQL)
-			}
-		}
+	return e.swapRuleSets(nil, compiled)
+}
 
-		for kind, idxs := range idata.Indexes {
-			for p, _ := range idxs {
-				allSQL = append(allSQL, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON resources (json_extract(DATA, '$.%s')) WHERE KIND = '%s'", kind, strings.ReplaceAll(p, ".", "_"), p, kind))
-			}
-		}
+// SetFocus pushes an agenda group onto the focus stack. While the stack is
+// non-empty only the group on top fires; it is popped once it has nothing
+// left to fire. With an empty stack every group may fire.
+func (e *Engine) SetFocus(group string) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	e.pushFocus(group)
+}
+
+func (e *Engine) Focus() string {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
 
-		e.ObjectMaps[ruleID] = idata.ObjectMap
-		ruleID++
+	return e.currentFocus()
+}
+
+// pushFocus and currentFocus are SetFocus and Focus for callers holding
+// txLock.
+func (e *Engine) pushFocus(group string) {
+	if len(e.focus) > 0 && e.focus[len(e.focus)-1] == group {
+		return
 	}
 
-	if err := e.ApplyInTransaction(allSQL); err != nil {
-		return err
+	e.focus = append(e.focus, group)
+}
+
+func (e *Engine) currentFocus() string {
+	if len(e.focus) == 0 {
+		return ""
 	}
 
-	for _, rule := range rs.Rules {
-		e.RuleNameToIndex[rule.Name] = e.RuleCount
-		e.IndexToRuleName[e.RuleCount] = rule.Name
-		e.RuleFunctions[e.RuleCount] = rule.Actions
-		e.RuleCount++
+	return e.focus[len(e.focus)-1]
+}
+
+const (
+	agendaSQL        = "SELECT instantiations.ID, ruleNum, json_group_array(res.value) FROM instantiations, json_each(instantiations.resources) res WHERE active AND (retry_at IS NULL OR retry_at <= ?) GROUP BY instantiations.ID, ruleNum ORDER BY priority, timestamp LIMIT ?"
+	focusedAgendaSQL = "SELECT instantiations.ID, ruleNum, json_group_array(res.value) FROM instantiations, json_each(instantiations.resources) res WHERE active AND (retry_at IS NULL OR retry_at <= ?) AND ruleNum IN (SELECT value FROM json_each(?)) GROUP BY instantiations.ID, ruleNum ORDER BY priority, timestamp LIMIT ?"
+)
+
+// agendaQuery returns the query for the next limit instantiations ready to
+// fire in the focus group, and its arguments.
+func (e *Engine) agendaQuery(limit int) (string, []interface{}) {
+	group := e.currentFocus()
+	if group == "" {
+		return agendaSQL, []interface{}{e.now().UnixNano(), limit}
 	}
 
-	return nil
+	nums := []string{}
+
+	for _, num := range e.GroupRules[group] {
+		nums = append(nums, strconv.Itoa(num))
+	}
+
+	return focusedAgendaSQL, []interface{}{e.now().UnixNano(), "[" + strings.Join(nums, ", ") + "]", limit}
+}
+
+// RunOptions bound a run. MaxFirings limits the number of actions run,
+// counting those that fail; zero or less means no limit.
+type RunOptions struct {
+	MaxFirings int
+}
+
+type Firing struct {
+	InstantiationID int
+	RuleIndex       int
+	Rule            string
+	Resources       []int
 }
 
 func (e *Engine) Run() error {
-	var id int
-	var ruleNum int
-	var resources string
+	_, _, err := e.run(context.Background(), RunOptions{})
 
-	instantiationErrors := map[int]int{}
+	return err
+}
 
-	for {
-		tx, err := e.DB.Begin()
-		if err != nil {
-			return err
+func (e *Engine) RunContext(ctx context.Context, opts RunOptions) error {
+	_, _, err := e.run(ctx, opts)
+
+	return err
+}
+
+// RunN runs at most n actions and returns how many of them succeeded.
+func (e *Engine) RunN(n int) (int, error) {
+	fired, _, err := e.run(context.Background(), RunOptions{MaxFirings: n})
+
+	return fired, err
+}
+
+func (e *Engine) Step() (*Firing, error) {
+	firing, _, err := e.fire(context.Background())
+
+	return firing, err
+}
+
+func (e *Engine) run(ctx context.Context, opts RunOptions) (int, bool, error) {
+	fired, attempted := 0, 0
+
+	for opts.MaxFirings <= 0 || attempted < opts.MaxFirings {
+		if err := ctx.Err(); err != nil {
+			return fired, false, err
 		}
 
-		//		defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+		firing, halted, err := e.fire(ctx)
+
+		// An interrupted statement surfaces as a driver error; report the
+		// cancellation instead.
+		if err != nil && ctx.Err() != nil {
+			return fired, false, ctx.Err()
+		}
 
-		err = tx.QueryRow("SELECT instantiations.ID, ruleNum, json_group_array(res.value) FROM instantiations, json_each(instantiations.resources) res GROUP BY instantiations.ID, ruleNum ORDER BY priority, timestamp LIMIT 1").Scan(&id, &ruleNum, &resources)
+		var limitErr *FiringLimitError
+
+		if firing != nil && !errors.As(err, &limitErr) {
+			attempted++
+		}
 
 		switch {
-		case err == sql.ErrNoRows:
-			return nil
+		case firing == nil:
+			return fired, false, err
 		case err != nil:
-			return err
+			// The failure has been recorded against the instantiation by
+			// the error policy, or it was dead-lettered for reaching its
+			// firing limit; carry on with the rest of the agenda.
 		default:
-			// statement, err := tx.Prepare("DELETE FROM instantiations WHERE ID = ?")
-			// if err != nil {
-			//  return err
-			// }
-
-			// defer statement.Close()
+			fired++
 
-			_, err = tx.Exec(fmt.Sprintf("DELETE FROM instantiations WHERE ID = %d", id))
-			if err != nil {
-				return err
+			if halted {
+				return fired, true, nil
 			}
+		}
+	}
+
+	return fired, false, nil
+}
+
+// fire runs the action of the next instantiation on the agenda in its own
+// transaction. It returns a nil Firing when the agenda is empty. An error
+// alongside a non-nil Firing is either an ActionError from the action, which
+// was rolled back, or a FiringLimitError for an instantiation that was
+// dead-lettered without running.
+func (e *Engine) fire(ctx context.Context) (_ *Firing, _ bool, err error) {
+	defer wrapStorageError(&err)
+
+	firing, halted, err := e.fireLocked(ctx)
+	e.dispatchEmitted()
+
+	return firing, halted, err
+}
+
+func (e *Engine) fireLocked(ctx context.Context) (*Firing, bool, error) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.beginTx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	firing, err := e.nextInstantiation(ctx, tx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Keep the timer and expiry bookkeeping done while looking at the agenda.
+	if firing == nil {
+		e.firingCounts = nil
+		return nil, false, tx.Commit()
+	}
+
+	// A runaway instantiation is dead-lettered so that the rest of the
+	// agenda can still fire.
+	if limitErr := e.checkFiringLimit(firing); limitErr != nil {
+		if err := e.deadLetter(ctx, tx, firing, limitErr); err != nil {
+			return nil, false, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+
+		return firing, false, limitErr
+	}
+
+	deleteStmt, err := e.prepared(ctx, tx, deleteInstantiationSQL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err = deleteStmt.ExecContext(ctx, firing.InstantiationID); err != nil {
+		return nil, false, err
+	}
+
+	mark, err := e.activationMark(ctx, tx, firing)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rc := e.newRuleContext(ctx, tx, firing)
 
-			var resIds []int
+	if err := e.CallAction(rc, e.RuleFunctions[firing.RuleIndex]); err != nil {
+		tx.Rollback()
 
-			if err := json.Unmarshal([]byte(resources), &resIds); err != nil {
-				return err
+		if ctx.Err() == nil {
+			if ferr := e.recordFailure(ctx, firing, err); ferr != nil {
+				return nil, false, ferr
 			}
+		}
+
+		return firing, false, &ActionError{Rule: firing.Rule, InstantiationID: firing.InstantiationID, Resources: firing.Resources, Err: err}
+	}
 
-			rc := &RuleContext{keyfunc: e.KeyFunction, tx: tx, resourceMap: e.ObjectMaps[ruleNum], resources: resIds}
+	if err := e.suppressActivations(ctx, tx, firing, mark); err != nil {
+		return nil, false, err
+	}
 
-			if err := e.CallAction(rc, e.RuleFunctions[ruleNum]); err != nil {
-				fmt.Printf("ERR: %v\n", err)
-				count := instantiationErrors[id]
-				if count > 3 {
-					return err
-				}
+	if err := e.reschedule(ctx, tx, firing); err != nil {
+		return nil, false, err
+	}
 
-				instantiationErrors[id] = count + 1
-				tx.Rollback()
-			} else {
-				delete(instantiationErrors, id)
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
 
-				if err := tx.Commit(); err != nil {
-					return err
-				}
+	e.countFiring(firing)
+	e.afterCommit(rc)
+
+	return firing, rc.halted, nil
+}
+
+// nextInstantiation returns the top of the agenda, popping exhausted focus
+// groups, or nil when nothing is left to fire.
+func (e *Engine) nextInstantiation(ctx context.Context, tx *sql.Tx) (*Firing, error) {
+	if err := e.expireResources(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	for {
+		var id, ruleNum int
+		var resources string
+
+		query, args := e.agendaQuery(1)
+
+		stmt, err := e.prepared(ctx, tx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		err = stmt.QueryRowContext(ctx, args...).Scan(&id, &ruleNum, &resources)
+
+		switch {
+		case err == sql.ErrNoRows:
+			if len(e.focus) > 0 {
+				e.focus = e.focus[:len(e.focus)-1]
+				continue
 			}
+
+			return nil, e.agendaDrained(ctx, tx)
+		case err != nil:
+			return nil, err
 		}
+
+		var resIds []int
+
+		if err := json.Unmarshal([]byte(resources), &resIds); err != nil {
+			return nil, err
+		}
+
+		return &Firing{InstantiationID: id, RuleIndex: ruleNum, Rule: e.IndexToRuleName[ruleNum], Resources: resIds}, nil
+	}
+}
+
+func (e *Engine) newRuleContext(ctx context.Context, tx *sql.Tx, firing *Firing) *RuleContext {
+	return &RuleContext{
+		ctx:         ctx,
+		engine:      e,
+		ruleNum:     firing.RuleIndex,
+		keyfunc:     e.KeyFunction,
+		tx:          tx,
+		resourceMap: e.ObjectMaps[firing.RuleIndex],
+		resources:   firing.Resources,
+		written:     map[int64]bool{},
+		read:        map[int64]bool{},
+	}
+}
+
+// afterCommit applies what a committed firing asked for once it is known to
+// have happened. The caller holds txLock; effects are delivered by
+// dispatchEmitted after it is released.
+func (e *Engine) afterCommit(rc *RuleContext) {
+	e.emitted = e.emitted || rc.emitted
+
+	for _, group := range rc.focus {
+		e.pushFocus(group)
 	}
 }
 
 type RuleContext struct {
+	ctx         context.Context
+	engine      *Engine
+	ruleNum     int
 	keyfunc     KeyFunc
 	tx          *sql.Tx
 	resourceMap map[string]int
 	resources   []int
+	focus       []string
+	halted      bool
+	emitted     bool
+	written     map[int64]bool
+	read        map[int64]bool
+	batch       *batchState
+	writing     bool
 }
 
-func (rc *RuleContext) Add(obj interface{}) error {
-	// stmt, err := rc.tx.Prepare(insertSQL)
-	// if err != nil {
-	//  return err
-	// }
+func (rc *RuleContext) Context() context.Context {
+	return rc.ctx
+}
+
+func (rc *RuleContext) SetFocus(group string) {
+	rc.focus = append(rc.focus, group)
+}
+
+func (rc *RuleContext) Halt() {
+	rc.halted = true
+}
+
+func (rc *RuleContext) Add(obj interface{}) (err error) {
+	defer wrapStorageError(&err)
+
+	_, err = rc.add(obj, false)
+
+	return err
+}
+
+func (rc *RuleContext) AddLogical(obj interface{}) (err error) {
+	defer wrapStorageError(&err)
+
+	id, err := rc.add(obj, true)
+	if err != nil {
+		return err
+	}
+
+	supports, err := json.Marshal(rc.resources)
+	if err != nil {
+		return err
+	}
 
-	// defer stmt.Close()
+	stmt, err := rc.engine.prepared(rc.ctx, rc.tx, justifySQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(rc.ctx, id, rc.ruleNum, string(supports))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// add inserts or updates obj. A logical add creates a resource that is
+// retracted with its last justification; it never takes over a resource
+// that was stated, while a stated add takes a resource out of truth
+// maintenance.
+func (rc *RuleContext) add(obj interface{}, logical bool) (int64, error) {
+	if err := rc.beginWrite(); err != nil {
+		return 0, err
+	}
+
+	var key interface{} = obj
+
+	var data []byte
 
 	switch v := obj.(type) {
 	case string:
-		kind, name, namespace, err := rc.keyfunc(v)
-		if err != nil {
-			return err
+		data = []byte(v)
+	case json.RawMessage:
+		key = string(v)
+		data = v
+	case []byte:
+		key = string(v)
+		data = v
+	case *FetchedResource:
+		if err := v.unmarshal(); err != nil {
+			return 0, err
 		}
 
-		_, err = rc.tx.Exec(fmt.Sprintf("INSERT INTO resources (KIND, NAME, NAMESPACE, DATA) VALUES ('%s', '%s', '%s', '%s') ON CONFLICT DO UPDATE SET DATA = excluded.DATA", kind, name, namespace, v))
+		s, err := json.Marshal(v.unmarshaled)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		return nil
-	case *FetchedResource:
-		err := v.unmarshal()
+		key = v.unmarshaled
+		data = s
+	case map[string]interface{}, Kinded:
+		s, err := json.Marshal(v)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		res := v.unmarshaled
+		data = s
+	default:
+		return 0, fmt.Errorf("%w: %T", ErrResourceType, obj)
+	}
+
+	kind, name, namespace, err := rc.keyfunc(key)
+	if err != nil {
+		return 0, err
+	}
+
+	id, same, rewritten, err := rc.engine.unchanged(rc.ctx, rc.tx, kind, name, namespace, string(data))
+	if err != nil {
+		return 0, err
+	}
 
-		s, err := json.Marshal(res)
+	if rewritten {
+		rc.markWritten(id)
+	}
+
+	if !same {
+		insert := insertSQL
+		if logical {
+			insert = logicalInsertSQL
+		}
+
+		stmt, err := rc.engine.prepared(rc.ctx, rc.tx, insert+" RETURNING ID")
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		//		kind, name, namespace := res["kind"].(string), res["metadata"].(map[string]interface{})["name"].(string), res["metadata"].(map[string]interface{})["namespace"].(string)
-		kind, name, namespace, err := rc.keyfunc(res)
+		if err := stmt.QueryRowContext(rc.ctx, kind, name, namespace, string(data)).Scan(&id); err != nil {
+			return 0, err
+		}
+
+		rc.markWritten(id)
+	}
+
+	if !logical {
+		stmt, err := rc.engine.prepared(rc.ctx, rc.tx, statedSQL)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		_, err = rc.tx.Exec(fmt.Sprintf("INSERT INTO resources (KIND, NAME, NAMESPACE, DATA) VALUES ('%s', '%s', '%s', '%s') ON CONFLICT DO UPDATE SET DATA = excluded.DATA", kind, name, namespace, s))
+		result, err := stmt.ExecContext(rc.ctx, kind, name, namespace)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		// _, err = stmt.Exec(kind, name, namespace, s)
-		// if err != nil {
-		//  return err
-		// }
+		if n, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if n > 0 {
+			rc.markWritten(id)
+		}
+	}
 
-		return nil
-	default:
-		return nil
+	if err := rc.engine.setExpiry(rc.ctx, rc.tx, kind, name, namespace, 0); err != nil {
+		return 0, err
 	}
+
+	return id, nil
 }
 
 type FetchedResource struct {
@@ -402,85 +808,235 @@ func (fr *FetchedResource) set(f FieldVal, val interface{}) error {
 		return err
 	}
 
-	var current interface{} = fr.unmarshaled
-
-	for _, segment := range f.Path[:len(f.Path)-1] {
-		intval, err := strconv.Atoi(segment)
+	var current interface{} = fr.unmarshaled
+
+	for _, segment := range f.Path[:len(f.Path)-1] {
+		intval, err := strconv.Atoi(segment)
+
+		if err != nil {
+			mapitem, ok := current.(map[string]interface{})
+			if !ok {
+				return badPath(f.Path)
+			}
+
+			sub, ok := mapitem[segment]
+			if !ok {
+				return badPath(f.Path)
+			}
+
+			current = sub
+		} else {
+			arrayitem, ok := current.([]interface{})
+			if !ok {
+				return badPath(f.Path)
+			}
+
+			if intval < 0 || intval >= len(arrayitem) {
+				return badPath(f.Path)
+			}
+
+			sub := arrayitem[intval]
+
+			current = sub
+		}
+	}
+
+	segment := f.Path[len(f.Path)-1]
+	intval, err := strconv.Atoi(segment)
+
+	if err != nil {
+		mapitem, ok := current.(map[string]interface{})
+		if !ok {
+			return badPath(f.Path)
+		}
+
+		mapitem[segment] = val
+	} else {
+		arrayitem, ok := current.([]interface{})
+		if !ok {
+			return badPath(f.Path)
+		}
+
+		arrayitem[intval] = val
+	}
+
+	return nil
+}
+
+func (fr *FetchedResource) get(f FieldVal) (interface{}, error) {
+	if err := fr.unmarshal(); err != nil {
+		return nil, err
+	}
+
+	var current interface{} = fr.unmarshaled
+
+	for _, segment := range f.Path {
+		intval, err := strconv.Atoi(segment)
+
+		if err != nil {
+			mapitem, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, badPath(f.Path)
+			}
+
+			sub, ok := mapitem[segment]
+			if !ok {
+				return nil, nil
+			}
+
+			current = sub
+		} else {
+			arrayitem, ok := current.([]interface{})
+			if !ok {
+				return nil, badPath(f.Path)
+			}
+
+			if intval < 0 || intval >= len(arrayitem) {
+				return nil, nil
+			}
+
+			current = arrayitem[intval]
+		}
+	}
+
+	return current, nil
+}
+
+func (fr *FetchedResource) Raw() (string, error) {
+	if fr.unmarshaled == nil {
+		return fr.raw, nil
+	}
+
+	s, err := json.Marshal(fr.unmarshaled)
+	if err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
+
+func (fr *FetchedResource) Get(f FieldVal) (interface{}, error) {
+	return fr.get(f)
+}
+
+func (rc *RuleContext) Set(item *FetchedResource, f FieldVal, val interface{}) (err error) {
+	defer wrapStorageError(&err)
+
+	return item.set(f, val)
+}
+
+const queryName = "queried"
+
+func (rc *RuleContext) Query(kind string, tests ...TestExp) (_ []*FetchedResource, err error) {
+	defer wrapStorageError(&err)
+
+	m := Match(kind, queryName, tests...)
+
+	data := &InstantiationData{
+		Names:   []string{queryName},
+		Kinds:   []string{kind},
+		Tables:  map[string]string{},
+		Refs:    map[string]bool{},
+		Queries: map[string]Queries{},
+		Indexes: map[string]map[string]bool{},
+	}
+
+	testExp, err := m.MatchGenerate().Instantiate(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var query strings.Builder
 
-		if err != nil {
-			mapitem, ok := current.(map[string]interface{})
-			if !ok {
-				return fmt.Errorf("bad path: %s", f.Path)
-			}
+	query.WriteString(fmt.Sprintf("SELECT %s.ID, %s.DATA FROM resources %s", queryName, queryName, queryName))
 
-			sub, ok := mapitem[segment]
-			if !ok {
-				return fmt.Errorf("bad path: %s", f.Path)
-			}
+	args := []interface{}{}
+	conds := []string{fmt.Sprintf("%s.KIND = ?", queryName), fmt.Sprintf("(%s.EXPIRES_AT IS NULL OR %s.EXPIRES_AT > ?)", queryName, queryName)}
 
-			current = sub
-		} else {
-			arrayitem, ok := current.([]interface{})
-			if !ok {
-				return fmt.Errorf("bad path: %s", f.Path)
-			}
+	args = append(args, kind, rc.engine.now().UnixNano())
 
-			if intval < 0 || intval >= len(arrayitem) {
-				return fmt.Errorf("bad path: %s", f.Path)
-			}
+	for ref := range data.Refs {
+		idx, ok := rc.resourceMap[ref]
+		if !ok {
+			return nil, unknownObject(ref)
+		}
 
-			sub := arrayitem[intval]
+		query.WriteString(fmt.Sprintf(", resources %s", ref))
+		conds = append(conds, fmt.Sprintf("%s.ID = ?", ref))
+		args = append(args, rc.resources[idx])
+	}
 
-			current = sub
-		}
+	if testExp != "" {
+		conds = append(conds, fmt.Sprintf("(%s)", testExp))
 	}
 
-	segment := f.Path[len(f.Path)-1]
-	intval, err := strconv.Atoi(segment)
+	query.WriteString(fmt.Sprintf(" WHERE %s ORDER BY %s.ID", strings.Join(conds, " AND "), queryName))
 
+	rows, err := rc.tx.QueryContext(rc.ctx, query.String(), args...)
 	if err != nil {
-		mapitem, ok := current.(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("bad path: %s", f.Path)
-		}
+		return nil, err
+	}
 
-		mapitem[segment] = val
-	} else {
-		arrayitem, ok := current.([]interface{})
-		if !ok {
-			return fmt.Errorf("bad path: %s", f.Path)
+	defer rows.Close()
+
+	results := []*FetchedResource{}
+
+	for rows.Next() {
+		var id int64
+		var raw string
+
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, err
 		}
 
-		arrayitem[intval] = val
+		rc.read[id] = true
+		results = append(results, &FetchedResource{raw: raw})
 	}
 
-	return nil
+	return results, rows.Err()
 }
 
-func (rc *RuleContext) Set(item *FetchedResource, f FieldVal, val interface{}) error {
-	return item.set(f, val)
+func (rc *RuleContext) Get(kind, name, namespace string) (_ *FetchedResource, err error) {
+	defer wrapStorageError(&err)
+
+	var id int64
+	var raw string
+
+	err = rc.tx.QueryRowContext(rc.ctx, "SELECT ID, DATA FROM resources WHERE KIND = ? AND NAME = ? AND NAMESPACE = ? AND (EXPIRES_AT IS NULL OR EXPIRES_AT > ?)", kind, name, namespace, rc.engine.now().UnixNano()).Scan(&id, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.read[id] = true
+
+	return &FetchedResource{raw: raw}, nil
 }
 
-func (rc *RuleContext) Delete(objname string) (*FetchedResource, error) {
+func (rc *RuleContext) Delete(objname string) (_ *FetchedResource, err error) {
+	defer wrapStorageError(&err)
+
 	idx, ok := rc.resourceMap[objname]
 	if !ok {
-		return nil, fmt.Errorf("unknown object: %s", objname)
+		return nil, unknownObject(objname)
 	}
 
-	// s, err := rc.tx.Prepare("DELETE FROM Resources WHERE ID = ? RETURNING DATA")
-	// if err != nil {
-	//  return nil, err
-	// }
+	if err := rc.beginWrite(); err != nil {
+		return nil, err
+	}
 
 	var objstr sql.NullString
 
-	//	err = s.QueryRow(fmt.Sprintf("DELETE FROM Resources WHERE ID = %s RETURNING DATA", rc.resources[idx])).Scan(&objstr)
-	// err = s.QueryRow(rc.resources[idx]).Scan(&objstr)
-	err := rc.tx.QueryRow(fmt.Sprintf("DELETE FROM Resources WHERE ID = %d RETURNING DATA", rc.resources[idx])).Scan(&objstr)
+	stmt, err := rc.engine.prepared(rc.ctx, rc.tx, deleteResourceSQL)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := stmt.QueryRowContext(rc.ctx, rc.resources[idx]).Scan(&objstr); err != nil {
+		return nil, err
+	}
+
+	rc.markWritten(int64(rc.resources[idx]))
+
 	if objstr.Valid {
 		val, err := objstr.Value()
 		if err != nil {
@@ -490,53 +1046,71 @@ func (rc *RuleContext) Delete(objname string) (*FetchedResource, error) {
 		return &FetchedResource{raw: val.(string)}, nil
 	}
 
-	return nil, fmt.Errorf("invalid deleted object: %s", objname)
+	return nil, fmt.Errorf("%w: %s", ErrDeletedObject, objname)
 }
 
-func (rc *RuleContext) UpdateField(objname string, f FieldVal, val interface{}) error {
+func (rc *RuleContext) UpdateField(objname string, f FieldVal, val interface{}) (err error) {
+	defer wrapStorageError(&err)
+
 	idx, ok := rc.resourceMap[objname]
 	if !ok {
-		return fmt.Errorf("unknown object: %s", objname)
+		return unknownObject(objname)
 	}
 
-	path := fmt.Sprintf("$.%s", strings.Join(f.Path, "."))
+	// Values are bound as JSON so that numbers, booleans, null, maps and
+	// slices keep their JSON types.
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("%w: %T", ErrResourceType, val)
+	}
 
-	var err error
+	path, err := jsonPath(f.Path)
+	if err != nil {
+		return err
+	}
 
-	switch v := val.(type) {
-	case int64:
-		_, err = rc.tx.Exec(fmt.Sprintf("UPDATE Resources SET data = json_set(data, '%s', %d) WHERE ID = %d", path, v, rc.resources[idx]))
-	case string:
-		_, err = rc.tx.Exec(fmt.Sprintf("UPDATE Resources SET data = json_set(data, '%s', json('%s') WHERE ID = %d", path, v, rc.resources[idx]))
+	if err := rc.beginWrite(); err != nil {
+		return err
 	}
 
+	stmt, err := rc.engine.prepared(rc.ctx, rc.tx, setFieldSQL)
 	if err != nil {
 		return err
 	}
 
+	if _, err := stmt.ExecContext(rc.ctx, path, string(encoded), rc.resources[idx]); err != nil {
+		return err
+	}
+
+	rc.markWritten(int64(rc.resources[idx]))
+
 	return nil
 }
 
-func (rc *RuleContext) GetIntField(objname string, f FieldVal, defaultValue int64) (int64, error) {
+func (rc *RuleContext) GetIntField(objname string, f FieldVal, defaultValue int64) (_ int64, err error) {
+	defer wrapStorageError(&err)
+
 	idx, ok := rc.resourceMap[objname]
 	if !ok {
-		return 0, fmt.Errorf("unknown object: %s", objname)
+		return 0, unknownObject(objname)
 	}
 
-	// s, err := rc.tx.Prepare("SELECT json_extract(data, ?) FROM Resources WHERE ID = ?")
-	// if err != nil {
-	//  return 0, err
-	// }
+	path, err := jsonPath(f.Path)
+	if err != nil {
+		return 0, err
+	}
 
 	var field sql.NullInt64
 
-	path := fmt.Sprintf("$.%s", strings.Join(f.Path, "."))
-
-	err := rc.tx.QueryRow(fmt.Sprintf("SELECT json_extract(data, '%s') FROM Resources WHERE ID = %d", path, rc.resources[idx])).Scan(&field)
+	stmt, err := rc.engine.prepared(rc.ctx, rc.tx, getFieldSQL)
 	if err != nil {
 		return 0, err
 	}
 
+	if err := stmt.QueryRowContext(rc.ctx, path, rc.resources[idx]).Scan(&field); err != nil {
+		return 0, err
+	}
+
 	if field.Valid {
 		val, err := field.Value()
 		if err != nil {
@@ -549,30 +1123,29 @@ func (rc *RuleContext) GetIntField(objname string, f FieldVal, defaultValue int6
 	return defaultValue, nil
 }
 
-func (rc *RuleContext) GetStringField(objname string, f FieldVal, defaultValue string) (string, error) {
+func (rc *RuleContext) GetStringField(objname string, f FieldVal, defaultValue string) (_ string, err error) {
+	defer wrapStorageError(&err)
+
 	idx, ok := rc.resourceMap[objname]
 	if !ok {
-		return "", fmt.Errorf("unknown object: %s", objname)
+		return "", unknownObject(objname)
 	}
 
-	// s, err := rc.tx.Prepare("SELECT json_extract(data, ?) FROM Resources WHERE ID = ?")
-	// if err != nil {
-	//  return "", err
-	// }
+	path, err := jsonPath(f.Path)
+	if err != nil {
+		return "", err
+	}
 
 	var field sql.NullString
 
-	path := fmt.Sprintf("$.%s", strings.Join(f.Path, "."))
-
-	err := rc.tx.QueryRow(fmt.Sprintf("SELECT json_extract(data, '%s') FROM Resources WHERE ID = %d", path, rc.resources[idx])).Scan(&field)
+	stmt, err := rc.engine.prepared(rc.ctx, rc.tx, getFieldSQL)
 	if err != nil {
 		return "", err
 	}
 
-	// err = s.QueryRow(path, rc.resources[idx]).Scan(&field)
-	// if err != nil {
-	//  return "", err
-	// }
+	if err := stmt.QueryRowContext(rc.ctx, path, rc.resources[idx]).Scan(&field); err != nil {
+		return "", err
+	}
 
 	if field.Valid {
 		val, err := field.Value()
@@ -590,44 +1163,52 @@ func (e *Engine) CallAction(rc *RuleContext, action ActionFunc) error {
 	return action(rc)
 }
 
-func (e *Engine) ApplyInTransaction(sql []string) error {
+func (e *Engine) ApplyInTransaction(sql []string) (err error) {
+	defer wrapStorageError(&err)
+
 	// for _, q :   = range sql {
 	//  fmt.Printf("SQL: %s\n", q)
 	// }
 
-	tx, err := e.DB.Begin()
+	tx, err := e.beginTx(context.Background())
 	if err != nil {
 		return err
 	}
 
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
 	for _, str := range sql {
 		stmt, err := tx.Prepare(str)
-
-		defer stmt.Close()
-
-		_, err = stmt.Exec()
 		if err != nil {
 			return err
 		}
 
+		_, err = stmt.Exec()
 		stmt.Close()
+
+		if err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
 }
 
-// func (e *Engine) GetResource(kind, name, namespace string) (string, error) {
-//  var id int
-//  var data string
+func (e *Engine) GetResource(kind, name, namespace string) (_ string, err error) {
+	defer wrapStorageError(&err)
 
-//  err := e.DB.QueryRow("SELECT ID, DATA FROM resources WHERE KIND = ? AND NAME = ? AND NAMESPACE = ?", kind, name, namespace).Scan(&id, &data)
-//  if err != nil {
-//      return "", err
-//  }
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
 
-//  //	fmt.Printf("ID: %d\n", id)
-//  return data, nil
-// }
+	var data string
+
+	err = e.DB.QueryRow("SELECT DATA FROM resources WHERE KIND = ? AND NAME = ? AND NAMESPACE = ? AND (EXPIRES_AT IS NULL OR EXPIRES_AT > ?)", kind, name, namespace, e.now().UnixNano()).Scan(&data)
+	if err != nil {
+		return "", err
+	}
+
+	return data, nil
+}
 
 func (e *Engine) AddResourceList(resources ...interface{}) error {
 	rstrings := []string{}
@@ -644,31 +1225,119 @@ func (e *Engine) AddResourceList(resources ...interface{}) error {
 	return e.AddResourceStringList(rstrings)
 }
 
-const insertSQL = "INSERT INTO resources (KIND, NAME, NAMESPACE, DATA) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET DATA = excluded.DATA"
+const (
+	insertSQL              = "INSERT INTO resources (KIND, NAME, NAMESPACE, DATA) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET DATA = excluded.DATA, EXPIRY_EVENT = false"
+	logicalInsertSQL       = "INSERT INTO resources (KIND, NAME, NAMESPACE, DATA, STATED) VALUES (?, ?, ?, ?, false) ON CONFLICT DO UPDATE SET DATA = excluded.DATA, EXPIRY_EVENT = false"
+	statedSQL              = "UPDATE resources SET STATED = true WHERE KIND = ? AND NAME = ? AND NAMESPACE = ? AND NOT STATED"
+	deleteResourceSQL      = "DELETE FROM Resources WHERE ID = ? RETURNING DATA"
+	deleteInstantiationSQL = "DELETE FROM instantiations WHERE ID = ?"
+	getFieldSQL            = "SELECT json_extract(data, ?) FROM Resources WHERE ID = ?"
+	setFieldSQL            = "UPDATE Resources SET data = json_set(data, ?, json(?)) WHERE ID = ?"
+	justifySQL             = "INSERT INTO justifications (resource_ID, ruleNum, resources) VALUES (?, ?, ?)"
+)
 
 func (e *Engine) AddResourceStringList(resourceStrs []string) error {
-	tx, err := e.DB.Begin()
+	return e.addResources(resourceStrs, 0)
+}
+
+func (e *Engine) addResources(resourceStrs []string, ttl time.Duration) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.beginTx(context.Background())
 	if err != nil {
 		return err
 	}
 
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
 	stmt, err := tx.Prepare(insertSQL)
+	if err != nil {
+		return err
+	}
 
 	defer stmt.Close()
 
+	changed := false
+
 	for _, rstr := range resourceStrs {
-		kind, name, namespace, err := e.KeyFunction(rstr)
+		stored, err := e.storeResource(tx, stmt, rstr, ttl)
 		if err != nil {
 			return err
 		}
 
-		_, err = stmt.Exec(kind, name, namespace, rstr)
-		if err != nil {
-			return err
+		changed = changed || stored
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if changed {
+		e.notify()
+	}
+
+	return nil
+}
+
+// storeResource inserts or updates one resource with the prepared insertSQL
+// statement and reports whether working memory changed.
+func (e *Engine) storeResource(tx *sql.Tx, stmt *sql.Stmt, rstr string, ttl time.Duration) (bool, error) {
+	kind, name, namespace, err := e.KeyFunction(rstr)
+	if err != nil {
+		return false, err
+	}
+
+	_, same, _, err := e.unchanged(context.Background(), tx, kind, name, namespace, rstr)
+	if err != nil {
+		return false, err
+	}
+
+	if !same {
+		if _, err = stmt.Exec(kind, name, namespace, rstr); err != nil {
+			return false, err
 		}
 	}
 
-	return tx.Commit()
+	if _, err := tx.Exec(statedSQL, kind, name, namespace); err != nil {
+		return false, err
+	}
+
+	// Re-adding a resource renews its time to live.
+	if err := e.setExpiry(context.Background(), tx, kind, name, namespace, ttl); err != nil {
+		return false, err
+	}
+
+	return !same, nil
+}
+
+func (e *Engine) DeleteResource(kind, name, namespace string) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.beginTx(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	_, err = tx.Exec("DELETE FROM resources WHERE KIND = ? AND NAME = ? AND NAMESPACE = ?", kind, name, namespace)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	e.notify()
+
+	return nil
 }
 
 func (i *InstantiationData) Gensym(matchIndex int) string {
@@ -730,12 +1399,20 @@ type ActionsVal struct {
 }
 
 type RuleVal struct {
-	Name       string
-	Priority   int
-	Actions    ActionFunc
-	Conditions ConditionsVal
-	Queries    map[string]Queries
-	Indices    []string
+	Name         string
+	Group        string
+	Priority     int
+	NoLoop       bool
+	LockOnActive bool
+	MaxFirings   int
+	After        time.Duration
+	Every        time.Duration
+	Deadline     *DeadlineVal
+	ErrorPolicy  *ErrorPolicy
+	Actions      ActionFunc
+	Conditions   ConditionsVal
+	Queries      map[string]Queries
+	Indices      []string
 }
 
 type AttributeVal struct {
@@ -809,7 +1486,7 @@ type NamespaceVal struct {
 
 func (n NamespaceVal) TestGenerate() Instantiable {
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
-		return fmt.Sprintf("%s.NAMESPACE = '%s'", data.Names[matchIndex], n.Name), nil
+		return fmt.Sprintf("%s.NAMESPACE = %s", data.Names[matchIndex], quoteSQL(n.Name)), nil
 	}}
 }
 
@@ -878,7 +1555,7 @@ func (s StringVal) LiteralValue() interface{} {
 
 func (s StringVal) ComparableGenerate() Instantiable {
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
-		return fmt.Sprintf("'%s'", s.Str), nil
+		return quoteSQL(s.Str), nil
 	}}
 }
 
@@ -1035,6 +1712,39 @@ func Name(n string) RuleArg {
 	}
 }
 
+func Group(name string) RuleArg {
+	return func(rv *RuleVal) {
+		rv.Group = name
+	}
+}
+
+func NoLoop() RuleArg {
+	return func(rv *RuleVal) {
+		rv.NoLoop = true
+	}
+}
+
+func LockOnActive() RuleArg {
+	return func(rv *RuleVal) {
+		rv.LockOnActive = true
+	}
+}
+
+// MaxFirings limits how often a rule may fire for the same tuple of
+// resources before the agenda next drains. It does not limit the rule's
+// firings across different tuples.
+func MaxFirings(n int) RuleArg {
+	return func(rv *RuleVal) {
+		rv.MaxFirings = n
+	}
+}
+
+func OnError(policy ErrorPolicy) RuleArg {
+	return func(rv *RuleVal) {
+		rv.ErrorPolicy = &policy
+	}
+}
+
 func Priority(n int) RuleArg {
 	return func(rv *RuleVal) {
 		rv.Priority = n
@@ -1042,7 +1752,7 @@ func Priority(n int) RuleArg {
 }
 
 func RuleSet(name string, rules ...*RuleVal) {
-	rulesets[name] = &RuleSetVal{Name: name, Rules: rules}
+	DefaultRegistry.RuleSet(name, rules...)
 }
 
 func Rule(data ...RuleArg) *RuleVal {
@@ -1058,18 +1768,74 @@ func Rule(data ...RuleArg) *RuleVal {
 func (r RuleVal) Instantiate(data *InstantiationData, matchIndex int) (string, error) {
 	cexp, err := r.Conditions.ConditionsGenerate().Instantiate(data, matchIndex)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	data.Queries[""] = Queries{Insert: cexp}
 	data.ObjectMap = map[string]int{}
 
+	if r.Deadline != nil {
+		known := false
+
+		for _, mv := range r.Conditions.MatchVals {
+			known = known || mv.Name == r.Deadline.Name
+		}
+
+		if !known {
+			return "", unknownObject(r.Deadline.Name)
+		}
+
+		path, err := jsonPath(r.Deadline.Field.Path)
+		if err != nil {
+			return "", err
+		}
+
+		addFieldCheck(data, r.Deadline.Name, path)
+	}
+
+	// A resource can fill any match of its kind, so an update re-matches the
+	// rule when a path referenced through any of those matches changes.
+	kindChecks := map[string]map[string]bool{}
+
+	for _, mv := range r.Conditions.MatchVals {
+		if kindChecks[mv.Kind] == nil {
+			kindChecks[mv.Kind] = map[string]bool{}
+		}
+
+		for check := range data.FieldChecks[mv.Name] {
+			kindChecks[mv.Kind][check] = true
+		}
+	}
+
+	changes := map[string]string{}
+
+	for kind, checkSet := range kindChecks {
+		checks := []string{}
+
+		for check := range checkSet {
+			checks = append(checks, check)
+		}
+
+		sort.Strings(checks)
+		changes[kind] = strings.Join(checks, " OR ")
+	}
+
+	deletes := map[string]bool{}
+
 	for idx, mv := range r.Conditions.MatchVals {
 		n := mv.Name
-		data.Queries[n] =
-			Queries{
-				Insert: fmt.Sprintf("CREATE TRIGGER %s_resources_i_%d AFTER INSERT ON resources WHEN NEW.KIND = '%s' BEGIN %s AND %s.ID = NEW.ID; END", n, data.RuleIndex, mv.Kind, cexp, n),
-				Update: fmt.Sprintf("CREATE TRIGGER %s_resources_u_%d AFTER UPDATE ON resources WHEN NEW.KIND = '%s' BEGIN %s AND %s.ID = NEW.ID; END", n, data.RuleIndex, mv.Kind, cexp, n)}
+		q := Queries{Insert: fmt.Sprintf("CREATE TRIGGER %s_resources_i_%d AFTER INSERT ON resources WHEN NEW.KIND = %s BEGIN %s AND %s.ID = NEW.ID; END", n, data.RuleIndex, quoteSQL(mv.Kind), cexp, n)}
+
+		if changed := changes[mv.Kind]; changed != "" {
+			q.Update = fmt.Sprintf("CREATE TRIGGER %s_resources_u_%d AFTER UPDATE ON resources WHEN NEW.KIND = %s AND NEW.IGNORED_UPDATES = OLD.IGNORED_UPDATES AND (%s) BEGIN %s AND %s.ID = NEW.ID; END", n, data.RuleIndex, quoteSQL(mv.Kind), changed, cexp, n)
+
+			if !deletes[mv.Kind] {
+				q.Delete = fmt.Sprintf("CREATE TRIGGER %s_resources_d_%d BEFORE UPDATE ON resources WHEN NEW.KIND = %s AND NEW.IGNORED_UPDATES = OLD.IGNORED_UPDATES AND (%s) BEGIN DELETE FROM instantiations WHERE ruleNum = %d AND ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = NEW.ID); DELETE FROM justifications WHERE ruleNum = %d AND ID IN (SELECT justification_ID FROM resource_justifications WHERE resource_ID = NEW.ID); END", n, data.RuleIndex, quoteSQL(mv.Kind), changed, data.RuleIndex, data.RuleIndex)
+				deletes[mv.Kind] = true
+			}
+		}
+
+		data.Queries[n] = q
 		data.ObjectMap[n] = idx
 	}
 
@@ -1166,10 +1932,10 @@ func selectExp(ruleIndex, priority int, tableMap map[string]string, matches []Ma
 
 	var kinds strings.Builder
 
-	kinds.WriteString(fmt.Sprintf(" WHERE %s.KIND = '%s'", matches[0].Name, matches[0].Kind))
+	kinds.WriteString(fmt.Sprintf(" WHERE %s.KIND = %s", matches[0].Name, quoteSQL(matches[0].Kind)))
 
 	for _, match := range matches[1:] {
-		kinds.WriteString(fmt.Sprintf(" AND %s.KIND = '%s'", match.Name, match.Kind))
+		kinds.WriteString(fmt.Sprintf(" AND %s.KIND = %s", match.Name, quoteSQL(match.Kind)))
 	}
 
 	var args strings.Builder
@@ -1192,7 +1958,7 @@ func (o ObjectVal) IterableObjectGenerate() Instantiable {
 			return "", err
 		}
 
-		return fmt.Sprintf("select json_object(key, value) from json_each('%s')", strval), nil
+		return fmt.Sprintf("select json_object(key, value) from json_each(%s)", quoteSQL(string(strval))), nil
 	}}
 }
 
@@ -1205,7 +1971,7 @@ func (a ArrayVal) IterableValueGenerate() Instantiable {
 			return "", err
 		}
 
-		return fmt.Sprintf("select value from json_each('%s')", strval), nil
+		return fmt.Sprintf("select value from json_each(%s)", quoteSQL(string(strval))), nil
 	},
 	}
 
@@ -1220,7 +1986,7 @@ func (a ArrayVal) IterableKeyGenerate() Instantiable {
 			return "", err
 		}
 
-		return fmt.Sprintf("select key from json_each('%s')", strval), nil
+		return fmt.Sprintf("select key from json_each(%s)", quoteSQL(string(strval))), nil
 	},
 	}
 }
@@ -1235,22 +2001,31 @@ func addIndex(data *InstantiationData, matchIndex int, path string) {
 	idxs[path] = true
 }
 
-func (f FieldVal) NumericGenerate() Instantiable {
-	path := strings.Join(f.Path, ".")
+func addFieldCheck(data *InstantiationData, name, path string) {
+	if data.FieldChecks == nil {
+		data.FieldChecks = map[string]map[string]bool{}
+	}
 
-	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
-		addIndex(data, matchIndex, path)
-		exp := fmt.Sprintf("json_extract(%s.DATA, '$.%s')", data.Names[matchIndex], path)
+	checks := data.FieldChecks[name]
+	if checks == nil {
+		checks = map[string]bool{}
+		data.FieldChecks[name] = checks
+	}
+
+	checks[fmt.Sprintf("json_extract(NEW.DATA, %s) IS NOT json_extract(OLD.DATA, %s)", quoteSQL(path), quoteSQL(path))] = true
+}
 
-		//      name := data.Names[matchIndex]
-		// //		nmap := data.FieldChecks[name]
+func (f FieldVal) NumericGenerate() Instantiable {
+	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(f.Path)
+		if err != nil {
+			return "", err
+		}
 
-		//      if nmap == nil {
-		//          nmap = map[string]bool{}
-		//          data.FieldChecks[name] = nmap
-		//      }
+		addIndex(data, matchIndex, path)
+		addFieldCheck(data, data.Names[matchIndex], path)
+		exp := fmt.Sprintf("json_extract(%s.DATA, %s)", data.Names[matchIndex], quoteSQL(path))
 
-		//      nmap[fmt.Sprintf("json_extract(NEW.DATA, '$.%s') <> json_extract(OLD.DATA, '$.%s')", path, path)] = true
 		return exp, nil
 	},
 	}
@@ -1261,55 +2036,71 @@ func (f FieldVal) ComparableGenerate() Instantiable {
 }
 
 func (f FieldVal) IterableValueGenerate() Instantiable {
-	path := strings.Join(f.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(f.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, data.Names[matchIndex], path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.Gensym(matchIndex)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select %s.value from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, baseTableName, name, name, strings.Join(f.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select %s.value from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
 func (f FieldVal) IterableKeyGenerate() Instantiable {
-	path := strings.Join(f.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(f.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, data.Names[matchIndex], path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.Gensym(matchIndex)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select %s.key from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, baseTableName, name, name, strings.Join(f.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select %s.key from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
 func (f FieldVal) IterableObjectGenerate() Instantiable {
-	path := strings.Join(f.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(f.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, data.Names[matchIndex], path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.Gensym(matchIndex)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select json_object(%s.key, %s.value) from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, eachName, baseTableName, name, name, strings.Join(f.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select json_object(%s.key, %s.value) from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
 func (j JoinFieldVal) NumericGenerate() Instantiable {
-	path := strings.Join(j.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(j.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, j.Name, path)
 		data.Refs[j.Name] = true
 
-		return fmt.Sprintf("json_extract(%s.DATA, '$.%s')", j.Name, strings.Join(j.Path, ".")), nil
+		return fmt.Sprintf("json_extract(%s.DATA, %s)", j.Name, quoteSQL(path)), nil
 	}}
 }
 
@@ -1318,44 +2109,56 @@ func (j JoinFieldVal) ComparableGenerate() Instantiable {
 }
 
 func (j JoinFieldVal) IterableValueGenerate() Instantiable {
-	path := strings.Join(j.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(j.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, j.Name, path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.NamedGensym(baseTableName)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select %s.value from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, baseTableName, name, name, strings.Join(j.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select %s.value from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
 func (j JoinFieldVal) IterableKeyGenerate() Instantiable {
-	path := strings.Join(j.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(j.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, j.Name, path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.NamedGensym(baseTableName)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select %s.key from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, baseTableName, name, name, strings.Join(j.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select %s.key from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
 func (j JoinFieldVal) IterableObjectGenerate() Instantiable {
-	path := strings.Join(j.Path, ".")
-
 	return Instantiable{InstFunc: func(data *InstantiationData, matchIndex int) (string, error) {
+		path, err := jsonPath(j.Path)
+		if err != nil {
+			return "", err
+		}
+
 		addIndex(data, matchIndex, path)
+		addFieldCheck(data, j.Name, path)
 		baseTableName := data.Tables[data.Names[matchIndex]]
 		name := data.NamedGensym(baseTableName)
 		eachName := data.NamedGensym("each")
 
-		return fmt.Sprintf("select json_object(%s.key, %s.value) from %s %s, json_each(%s.DATA, '$.%s') %s where %s.id = %s.id",
-			eachName, eachName, baseTableName, name, name, strings.Join(j.Path, "."), eachName, name, baseTableName), nil
+		return fmt.Sprintf("select json_object(%s.key, %s.value) from %s %s, json_each(%s.DATA, %s) %s where %s.id = %s.id",
+			eachName, eachName, baseTableName, name, name, quoteSQL(path), eachName, name, baseTableName), nil
 	}}
 }
 
@@ -0,0 +1,206 @@
+package rules
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+type Effect struct {
+	ID       int64
+	Key      string
+	Kind     string
+	Payload  interface{}
+	Attempts int
+}
+
+type DispatchFunc func(effect Effect) error
+
+// Emit queues an effect to be delivered once the firing commits. An effect
+// with a Key is delivered at most once per key: emitting the same effect
+// again, whether or not the first was delivered, does nothing, and emitting a
+// different effect under a used key fails with ErrEffectKey.
+func (rc *RuleContext) Emit(effect Effect) (err error) {
+	defer wrapStorageError(&err)
+
+	if err := rc.beginWrite(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(effect.Payload)
+	if err != nil {
+		return err
+	}
+
+	var key sql.NullString
+
+	if effect.Key != "" {
+		key = sql.NullString{String: effect.Key, Valid: true}
+
+		var same bool
+
+		err := rc.tx.QueryRowContext(rc.ctx, "SELECT kind = ? AND json(payload) = json(?) FROM outbox WHERE idempotency_key = ?", effect.Kind, string(payload), effect.Key).Scan(&same)
+
+		switch {
+		case err == nil && same:
+			return nil
+		case err == nil:
+			return fmt.Errorf("%w: %s", ErrEffectKey, effect.Key)
+		case err != sql.ErrNoRows:
+			return err
+		}
+	}
+
+	_, err = rc.tx.ExecContext(rc.ctx, "INSERT INTO outbox (idempotency_key, kind, payload) VALUES (?, ?, ?)", key, effect.Kind, string(payload))
+	if err != nil {
+		return err
+	}
+
+	rc.emitted = true
+
+	return nil
+}
+
+// SetDispatcher delivers effects as soon as the firings that emitted them
+// commit. The dispatcher runs outside the engine's transaction and may call
+// back into the engine.
+func (e *Engine) SetDispatcher(d DispatchFunc) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	e.dispatcher = d
+}
+
+// SetDispatchErrorHandler receives errors from deliveries made for the
+// dispatcher set with SetDispatcher. Without one they are logged.
+func (e *Engine) SetDispatchErrorHandler(h func(error)) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	e.dispatchErrors = h
+}
+
+// dispatchEmitted delivers effects emitted by committed firings to the
+// dispatcher. The caller must not hold txLock. Undelivered effects stay in
+// the outbox for a later Dispatch.
+func (e *Engine) dispatchEmitted() {
+	e.txLock.Lock()
+	dispatcher, handler, emitted := e.dispatcher, e.dispatchErrors, e.emitted
+	e.emitted = false
+	e.txLock.Unlock()
+
+	if dispatcher == nil || !emitted {
+		return
+	}
+
+	if _, err := e.Dispatch(dispatcher); err != nil {
+		if handler == nil {
+			log.Printf("gorules: dispatching effects: %v", err)
+			return
+		}
+
+		handler(err)
+	}
+}
+
+func (e *Engine) PendingEffects() (_ []Effect, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	rows, err := e.DB.Query("SELECT ID, idempotency_key, kind, payload, attempts FROM outbox WHERE delivered_at IS NULL ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	effects := []Effect{}
+
+	for rows.Next() {
+		var effect Effect
+		var key sql.NullString
+		var payload string
+
+		if err := rows.Scan(&effect.ID, &key, &effect.Kind, &payload, &effect.Attempts); err != nil {
+			return nil, err
+		}
+
+		effect.Key = key.String
+		if !key.Valid {
+			effect.Key = strconv.FormatInt(effect.ID, 10)
+		}
+
+		effect.Payload = json.RawMessage(payload)
+		effects = append(effects, effect)
+	}
+
+	return effects, rows.Err()
+}
+
+// Dispatch delivers committed effects in the order they were emitted. An
+// effect is marked delivered only after the handler succeeds, so a crash
+// between the two delivers it again; handlers should use Effect.Key to drop
+// duplicates. Delivered effects with a key are kept so the key is not
+// reused; ForgetDeliveredEffects removes them. Dispatch stops at the first
+// failure and returns the number delivered.
+func (e *Engine) Dispatch(handler DispatchFunc) (_ int, err error) {
+	defer wrapStorageError(&err)
+
+	effects, err := e.PendingEffects()
+	if err != nil {
+		return 0, err
+	}
+
+	for count, effect := range effects {
+		effect.Attempts++
+
+		if herr := handler(effect); herr != nil {
+			if err := e.execLocked("UPDATE outbox SET attempts = ?, error = ? WHERE ID = ?", effect.Attempts, herr.Error(), effect.ID); err != nil {
+				return count, err
+			}
+
+			return count, herr
+		}
+
+		err := e.execLocked("UPDATE outbox SET attempts = ?, error = NULL, delivered_at = ? WHERE ID = ? AND idempotency_key IS NOT NULL", effect.Attempts, e.now().UnixNano(), effect.ID)
+		if err == nil {
+			err = e.execLocked("DELETE FROM outbox WHERE ID = ? AND idempotency_key IS NULL", effect.ID)
+		}
+
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return len(effects), nil
+}
+
+// ForgetDeliveredEffects removes effects delivered before the given time,
+// after which their keys may be used again.
+func (e *Engine) ForgetDeliveredEffects(before time.Time) (_ int64, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	res, err := e.DB.Exec("DELETE FROM outbox WHERE delivered_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (e *Engine) execLocked(query string, args ...interface{}) error {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	_, err := e.DB.Exec(query, args...)
+
+	return err
+}
@@ -0,0 +1,352 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+)
+
+// RunParallel fires the agenda like Run, but runs the actions of up to
+// workers instantiations with disjoint resource sets at the same time. The
+// batch shares one transaction, so SQLite still applies statements one at a
+// time; what runs concurrently is the Go code in the actions.
+//
+// A firing's writes are applied together, inside a savepoint, while the
+// other firings wait to write. A firing that read or wrote a resource
+// another firing of the batch wrote is rolled back and left on the agenda,
+// as is one whose action failed; the rest of the batch commits. Reads are
+// tracked by the resources Get and Query return, so a resource added by one
+// firing that another firing's query would have returned is not detected.
+// Rolled back firings are retried one at a time before the next batch.
+func (e *Engine) RunParallel(ctx context.Context, workers int) (err error) {
+	defer wrapStorageError(&err)
+
+	if workers < 2 {
+		return e.RunContext(ctx, RunOptions{})
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		size, retry, halted, err := e.fireBatch(ctx, workers)
+		e.dispatchEmitted()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		if halted || size == 0 {
+			return nil
+		}
+
+		// Each retry is one attempt, whether or not it fires.
+		for i := 0; i < retry; i++ {
+			firing, halted, err := e.fire(ctx)
+
+			if err != nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			switch {
+			case firing == nil && err != nil:
+				return err
+			case firing == nil:
+				return nil
+			case err == nil && halted:
+				return nil
+			}
+		}
+	}
+}
+
+// batchState is shared by the firings of a batch.
+type batchState struct {
+	write    sync.Mutex // held by the firing whose writes are in progress
+	lock     sync.Mutex // guards the written sets of the batch's contexts
+	contexts []*RuleContext
+}
+
+// beginWrite is called before each write an action makes. Within a batch,
+// a firing's first write waits for the firing writing before it to finish
+// and opens a savepoint, so that its writes can be rolled back on their own.
+func (rc *RuleContext) beginWrite() error {
+	if rc.batch == nil || rc.writing {
+		return nil
+	}
+
+	rc.batch.write.Lock()
+
+	if _, err := rc.tx.ExecContext(rc.ctx, "SAVEPOINT batch_firing"); err != nil {
+		rc.batch.write.Unlock()
+		return err
+	}
+
+	rc.writing = true
+
+	return nil
+}
+
+func (rc *RuleContext) markWritten(id int64) {
+	if rc.batch != nil {
+		rc.batch.lock.Lock()
+		defer rc.batch.lock.Unlock()
+	}
+
+	rc.written[id] = true
+}
+
+// settle ends a batch firing once its action has returned. It reports
+// whether the firing conflicted with another; the writes of a conflicting
+// or failed firing are rolled back.
+func (rc *RuleContext) settle(failed bool) (bool, error) {
+	b := rc.batch
+
+	b.lock.Lock()
+	conflict := b.conflicting(rc)
+	b.lock.Unlock()
+
+	if !rc.writing {
+		return conflict, nil
+	}
+
+	defer b.write.Unlock()
+
+	rc.writing = false
+
+	if conflict || failed {
+		if _, err := rc.tx.ExecContext(rc.ctx, "ROLLBACK TO batch_firing"); err != nil {
+			return conflict, err
+		}
+	}
+
+	_, err := rc.tx.ExecContext(rc.ctx, "RELEASE batch_firing")
+
+	return conflict, err
+}
+
+// conflicting reports whether another firing of the batch has written a
+// resource that rc read or wrote. The caller holds b.lock.
+func (b *batchState) conflicting(rc *RuleContext) bool {
+	for _, other := range b.contexts {
+		if other == rc {
+			continue
+		}
+
+		for id := range other.written {
+			if rc.read[id] || rc.written[id] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// fireBatch fires one batch of independent instantiations. It returns how
+// many instantiations it took from the agenda, zero meaning the agenda is
+// empty, and how many of them are left to be fired one at a time.
+func (e *Engine) fireBatch(ctx context.Context, workers int) (int, int, bool, error) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.beginTx(ctx)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	batch, err := e.independentInstantiations(ctx, tx, workers)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if len(batch) == 0 {
+		e.firingCounts = nil
+		return 0, 0, false, tx.Commit()
+	}
+
+	if len(batch) < 2 {
+		return len(batch), len(batch), false, nil
+	}
+
+	state := &batchState{contexts: make([]*RuleContext, len(batch))}
+	marks := make([]int64, len(batch))
+	errs := make([]error, len(batch))
+	conflicts := make([]bool, len(batch))
+	settleErrs := make([]error, len(batch))
+
+	for i, firing := range batch {
+		// Let the serial path report a firing limit violation.
+		if e.checkFiringLimit(firing) != nil {
+			return len(batch), len(batch), false, nil
+		}
+
+		if marks[i], err = e.activationMark(ctx, tx, firing); err != nil {
+			return 0, 0, false, err
+		}
+
+		rc := e.newRuleContext(ctx, tx, firing)
+		rc.batch = state
+
+		for _, r := range firing.Resources {
+			rc.read[int64(r)] = true
+		}
+
+		state.contexts[i] = rc
+	}
+
+	var wg sync.WaitGroup
+
+	for i, firing := range batch {
+		wg.Add(1)
+
+		go func(i int, firing *Firing) {
+			defer wg.Done()
+
+			errs[i] = e.CallAction(state.contexts[i], e.RuleFunctions[firing.RuleIndex])
+			conflicts[i], settleErrs[i] = state.contexts[i].settle(errs[i] != nil)
+		}(i, firing)
+	}
+
+	wg.Wait()
+
+	for _, err := range settleErrs {
+		if err != nil {
+			return 0, 0, false, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, 0, false, err
+	}
+
+	retry := 0
+	fired := []int{}
+
+	for i, firing := range batch {
+		switch {
+		case conflicts[i]:
+			retry++
+		case errs[i] == nil:
+			fired = append(fired, i)
+
+			if _, err := tx.ExecContext(ctx, deleteInstantiationSQL, firing.InstantiationID); err != nil {
+				return 0, 0, false, err
+			}
+
+			if err := e.suppressActivations(ctx, tx, firing, marks[i]); err != nil {
+				return 0, 0, false, err
+			}
+
+			if err := e.reschedule(ctx, tx, firing); err != nil {
+				return 0, 0, false, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, false, err
+	}
+
+	// Failed firings stay on the agenda, subject to their error policy.
+	for i, firing := range batch {
+		if errs[i] != nil && !conflicts[i] {
+			if err := e.recordFailure(ctx, firing, errs[i]); err != nil {
+				return 0, 0, false, err
+			}
+		}
+	}
+
+	halted := false
+
+	for _, i := range fired {
+		e.countFiring(batch[i])
+		e.afterCommit(state.contexts[i])
+		halted = halted || state.contexts[i].halted
+	}
+
+	return len(batch), retry, halted, nil
+}
+
+// independentInstantiations takes instantiations from the top of the agenda,
+// skipping any that share a resource with one already taken.
+func (e *Engine) independentInstantiations(ctx context.Context, tx *sql.Tx, workers int) ([]*Firing, error) {
+	if err := e.expireResources(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	for {
+		query, args := e.agendaQuery(workers * 4)
+
+		stmt, err := e.prepared(ctx, tx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := stmt.QueryContext(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		batch := []*Firing{}
+		used := map[int]bool{}
+
+		for rows.Next() && len(batch) < workers {
+			var id, ruleNum int
+			var resources string
+
+			if err := rows.Scan(&id, &ruleNum, &resources); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			var resIds []int
+
+			if err := json.Unmarshal([]byte(resources), &resIds); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			overlaps := false
+
+			for _, r := range resIds {
+				overlaps = overlaps || used[r]
+			}
+
+			if overlaps {
+				continue
+			}
+
+			for _, r := range resIds {
+				used[r] = true
+			}
+
+			batch = append(batch, &Firing{InstantiationID: id, RuleIndex: ruleNum, Rule: e.IndexToRuleName[ruleNum], Resources: resIds})
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if len(batch) == 0 && len(e.focus) > 0 {
+			e.focus = e.focus[:len(e.focus)-1]
+			continue
+		}
+
+		if len(batch) == 0 {
+			return batch, e.agendaDrained(ctx, tx)
+		}
+
+		return batch, nil
+	}
+}
@@ -0,0 +1,40 @@
+package rules
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	plainPathLabel = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\[[0-9]+\])*$`)
+	unsafeName     = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// quoteSQL renders s as an SQL string literal.
+func quoteSQL(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// jsonPath renders a field path as an SQLite JSON path, quoting labels that
+// would otherwise be read as path syntax. SQLite compares a quoted label
+// with the key as it is written in the JSON text, so backslashes are
+// escaped as they are there; a label holding a double quote cannot be
+// written at all.
+func jsonPath(path []string) (string, error) {
+	var b strings.Builder
+
+	b.WriteString("$")
+
+	for _, label := range path {
+		switch {
+		case plainPathLabel.MatchString(label):
+			b.WriteString("." + label)
+		case strings.Contains(label, `"`):
+			return "", badPath(path)
+		default:
+			b.WriteString(`."` + strings.ReplaceAll(label, `\`, `\\`) + `"`)
+		}
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,220 @@
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// When an engine opens a database that already has rules installed, each
+// pending instantiation is handed to the installed rule with the same
+// identity, a name plus a hash of what the rule compiles to, whatever index
+// that rule now has. Instantiations whose rule changed or went away are
+// dropped, as are triggers that no installed rule needs.
+
+// ruleIdentity names a rule by its name and content. Compiling at a fixed
+// index keeps the hash independent of where the rule is installed. The
+// rule's position within its rule set and the number of earlier copies of
+// that rule set tell apart the copies of a rule set installed more than once.
+func ruleIdentity(rule *RuleVal, group string, position, occurrence int) (string, error) {
+	idata := &InstantiationData{
+		Names:   []string{},
+		Tables:  map[string]string{},
+		Refs:    map[string]bool{},
+		Queries: map[string]Queries{},
+		Indexes: map[string]map[string]bool{},
+	}
+
+	match, err := rule.Instantiate(idata, 0)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{match}
+
+	for key, q := range idata.Queries {
+		if key != "" {
+			parts = append(parts, q.Insert, q.Update, q.Delete)
+		}
+	}
+
+	sort.Strings(parts)
+	parts = append(parts, fmt.Sprintf("%d|%d|%s|%d|%t|%t|%d|%v|%v|%+v", position, occurrence, group, rule.Priority, rule.NoLoop, rule.LockOnActive, rule.MaxFirings, rule.After, rule.Every, rule.Deadline))
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+
+	return fmt.Sprintf("%s@%s", rule.Name, hex.EncodeToString(sum[:8])), nil
+}
+
+func triggerRuleNum(name string) (int, bool) {
+	idx := strings.LastIndex(name, "_")
+	if idx < 0 {
+		return 0, false
+	}
+
+	num, err := strconv.Atoi(name[idx+1:])
+
+	return num, err == nil
+}
+
+func (e *Engine) loadStaleRules() error {
+	rows, err := e.DB.Query("SELECT name, sql FROM sqlite_master WHERE type = 'trigger' AND (name GLOB '*_resources_[iud]_[0-9]*' OR name GLOB 'rule_disabled_TRIGGER_[0-9]*')")
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	e.staleTriggers = map[string]string{}
+	disabled := []string{}
+
+	for rows.Next() {
+		var name, sql string
+
+		if err := rows.Scan(&name, &sql); err != nil {
+			return err
+		}
+
+		// Installing a rule recreates its disabled trigger if it needs one.
+		if strings.HasPrefix(name, "rule_disabled_TRIGGER_") {
+			disabled = append(disabled, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", name))
+			continue
+		}
+
+		e.staleTriggers[name] = sql
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows.Close()
+
+	ids, err := e.DB.Query("SELECT identity FROM rules")
+	if err != nil {
+		return err
+	}
+
+	defer ids.Close()
+
+	e.staleRules = map[string]bool{}
+
+	for ids.Next() {
+		var identity string
+
+		if err := ids.Scan(&identity); err != nil {
+			return err
+		}
+
+		e.staleRules[identity] = true
+	}
+
+	if err := ids.Err(); err != nil {
+		return err
+	}
+
+	ids.Close()
+
+	return e.ApplyInTransaction(disabled)
+}
+
+// adoptTriggers reports whether the triggers already installed for a rule's
+// index are exactly the ones it needs.
+func (e *Engine) adoptTriggers(cr *compiledRule) bool {
+	stale := 0
+
+	for name := range e.staleTriggers {
+		if num, ok := triggerRuleNum(name); ok && num == cr.index {
+			stale++
+		}
+	}
+
+	if stale == 0 || stale != len(cr.triggers) {
+		return false
+	}
+
+	for _, name := range cr.triggers {
+		if e.staleTriggers[name] != cr.triggerSQL[name] {
+			return false
+		}
+	}
+
+	for _, name := range cr.triggers {
+		delete(e.staleTriggers, name)
+	}
+
+	return true
+}
+
+// staleTriggerDrops removes the triggers a previous engine installed at an
+// index before a different rule takes it over.
+func (e *Engine) staleTriggerDrops(ruleNum int) []string {
+	stmts := []string{}
+
+	for name := range e.staleTriggers {
+		if num, ok := triggerRuleNum(name); ok && num == ruleNum {
+			stmts = append(stmts, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", name))
+			delete(e.staleTriggers, name)
+		}
+	}
+
+	return stmts
+}
+
+// resumeStatements hands the pending instantiations and justifications of
+// a rule installed by a previous engine to the rule's new index. Databases
+// from before rule identities were recorded have none, so there the rows of
+// a rule whose triggers were adopted are claimed in place. It returns nil if
+// there is nothing to resume.
+func (e *Engine) resumeStatements(cr *compiledRule, adopted bool) []string {
+	id := quoteSQL(cr.identity)
+
+	if e.staleRules[cr.identity] {
+		delete(e.staleRules, cr.identity)
+
+		return []string{
+			fmt.Sprintf("UPDATE instantiations SET ruleNum = %d WHERE rule_id = %s", cr.index, id),
+			fmt.Sprintf("UPDATE justifications SET ruleNum = %d WHERE rule_id = %s", cr.index, id),
+		}
+	}
+
+	if adopted && len(e.staleRules) == 0 {
+		return []string{
+			fmt.Sprintf("UPDATE instantiations SET rule_id = %s WHERE ruleNum = %d AND rule_id IS NULL", id, cr.index),
+			fmt.Sprintf("UPDATE justifications SET rule_id = %s WHERE ruleNum = %d AND rule_id IS NULL", id, cr.index),
+		}
+	}
+
+	return nil
+}
+
+// dropStaleRules removes whatever is left from rules the new engine did not
+// install.
+func (e *Engine) dropStaleRules() error {
+	stmts := []string{}
+
+	for name := range e.staleTriggers {
+		stmts = append(stmts, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", name))
+	}
+
+	nums := []string{}
+	identities := []string{}
+
+	for num := range e.Rules {
+		nums = append(nums, strconv.Itoa(num))
+		identities = append(identities, quoteSQL(e.ruleIdentities[num]))
+	}
+
+	stmts = append(stmts,
+		fmt.Sprintf("DELETE FROM rules WHERE ruleNum NOT IN (%s)", strings.Join(nums, ", ")),
+		fmt.Sprintf("DELETE FROM instantiations WHERE rule_id IS NULL OR rule_id NOT IN (%s)", strings.Join(identities, ", ")),
+		fmt.Sprintf("DELETE FROM justifications WHERE rule_id IS NULL OR rule_id NOT IN (%s)", strings.Join(identities, ", ")))
+
+	e.staleTriggers = nil
+	e.staleRules = nil
+
+	return e.ApplyInTransaction(stmts)
+}
@@ -0,0 +1,45 @@
+package rules
+
+import (
+	"sync"
+)
+
+// A Registry holds named rule sets for the engines created from it.
+// Services that host several independent rule bases should give each its
+// own Registry rather than sharing DefaultRegistry.
+type Registry struct {
+	lock     sync.Mutex
+	rulesets map[string]*RuleSetVal
+}
+
+// DefaultRegistry backs the package-level RuleSet, NewEngine and
+// NewK8sEngine functions.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{rulesets: map[string]*RuleSetVal{}}
+}
+
+func (r *Registry) RuleSet(name string, rules ...*RuleVal) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.rulesets[name] = &RuleSetVal{Name: name, Rules: rules}
+}
+
+func (r *Registry) Lookup(name string) (*RuleSetVal, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rs, ok := r.rulesets[name]
+
+	return rs, ok
+}
+
+func (r *Registry) NewEngine(path string, rulesets ...string) (*Engine, error) {
+	return newEngine(path, r, defaultKeyFunc, rulesets)
+}
+
+func (r *Registry) NewK8sEngine(path string, rulesets ...string) (*Engine, error) {
+	return newEngine(path, r, KubernetesKeyFunc, rulesets)
+}
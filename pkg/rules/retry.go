@@ -0,0 +1,169 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// An ErrorPolicy decides what happens to an instantiation whose action
+// fails. The instantiation is parked until Backoff(attempts) has passed and
+// then fired again; after MaxAttempts failures it is moved to the dead
+// letter table. A MaxAttempts of zero or less means
+// DefaultErrorPolicy.MaxAttempts, and a nil Backoff retries immediately.
+type ErrorPolicy struct {
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+}
+
+var DefaultErrorPolicy = ErrorPolicy{MaxAttempts: 5}
+
+func ExponentialBackoff(base, max time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		delay := base
+
+		for i := 1; i < attempts && delay < max; i++ {
+			delay *= 2
+		}
+
+		if delay > max {
+			return max
+		}
+
+		return delay
+	}
+}
+
+type DeadLetter struct {
+	ID        int
+	Rule      string
+	RuleIndex int
+	Resources []int
+	Attempts  int
+	Error     string
+	Time      time.Time
+}
+
+func (e *Engine) errorPolicy(ruleNum int) ErrorPolicy {
+	policy := e.ErrorPolicy
+
+	if rule := e.Rules[ruleNum]; rule != nil && rule.ErrorPolicy != nil {
+		policy = *rule.ErrorPolicy
+	}
+
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultErrorPolicy.MaxAttempts
+	}
+
+	return policy
+}
+
+// recordFailure applies the error policy to an instantiation whose action
+// failed and was rolled back.
+func (e *Engine) recordFailure(ctx context.Context, firing *Firing, actionErr error) error {
+	policy := e.errorPolicy(firing.RuleIndex)
+
+	tx, err := e.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	var attempts int
+
+	err = tx.QueryRowContext(ctx, "UPDATE instantiations SET attempts = attempts + 1 WHERE ID = ? RETURNING attempts", firing.InstantiationID).Scan(&attempts)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	now := e.now()
+
+	if attempts >= policy.MaxAttempts {
+		if err := e.deadLetter(ctx, tx, firing, actionErr); err != nil {
+			return err
+		}
+	} else if policy.Backoff != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE instantiations SET retry_at = ? WHERE ID = ?", now.Add(policy.Backoff(attempts)).UnixNano(), firing.InstantiationID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deadLetter moves an instantiation from the agenda to the dead letter
+// table.
+func (e *Engine) deadLetter(ctx context.Context, tx *sql.Tx, firing *Firing, cause error) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO dead_letters (ruleNum, resources, attempts, error, timestamp) SELECT ruleNum, resources, attempts, ?, ? FROM instantiations WHERE ID = ?", cause.Error(), e.now().UnixNano(), firing.InstantiationID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ID = ?", firing.InstantiationID)
+
+	return err
+}
+
+// NextRetry returns the time at which the earliest parked instantiation
+// becomes ready to fire again.
+func (e *Engine) NextRetry(ctx context.Context) (_ time.Time, _ bool, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	var retryAt sql.NullInt64
+
+	if err := e.DB.QueryRowContext(ctx, "SELECT min(retry_at) FROM instantiations WHERE active").Scan(&retryAt); err != nil {
+		return time.Time{}, false, err
+	}
+
+	if !retryAt.Valid {
+		return time.Time{}, false, nil
+	}
+
+	return time.Unix(0, retryAt.Int64), true, nil
+}
+
+func (e *Engine) DeadLetters() (_ []DeadLetter, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	rows, err := e.DB.Query("SELECT ID, ruleNum, resources, attempts, error, timestamp FROM dead_letters ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+
+	for rows.Next() {
+		var letter DeadLetter
+		var resources string
+		var timestamp int64
+
+		if err := rows.Scan(&letter.ID, &letter.RuleIndex, &resources, &letter.Attempts, &letter.Error, &timestamp); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(resources), &letter.Resources); err != nil {
+			return nil, err
+		}
+
+		letter.Rule = e.IndexToRuleName[letter.RuleIndex]
+		letter.Time = time.Unix(0, timestamp)
+		letters = append(letters, letter)
+	}
+
+	return letters, rows.Err()
+}
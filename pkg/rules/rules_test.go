@@ -1,9 +1,15 @@
 package rules
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -22,8 +28,10 @@ var _ = Describe("Simple Expression Tests", func() {
 	BeforeEach(func() {
 		args = &InstantiationData{
 			Names:   []string{"obj", "otherObject", "yetAnotherObject"},
+			Kinds:   []string{"Obj", "OtherObject", "YetAnotherObject"},
 			Queries: map[string]Queries{},
 			Refs:    map[string]bool{},
+			Indexes: map[string]map[string]bool{},
 			//			FieldChecks: map[string]map[string]bool{},
 			Tables: map[string]string{
 				"obj":              "objtab",
@@ -276,9 +284,10 @@ var _ = Describe("Rule Tests", func() {
 
 	BeforeEach(func() {
 		args = &InstantiationData{
-			Names:   []string{"foo", "bar"},
+			Names:   []string{},
 			Queries: map[string]Queries{},
 			Refs:    map[string]bool{},
+			Indexes: map[string]map[string]bool{},
 			//			FieldChecks: map[string]map[string]bool{},
 			RuleIndex: 20,
 			Priority:  10,
@@ -292,18 +301,17 @@ var _ = Describe("Rule Tests", func() {
 				Match("Deployment", "foo", Namespace("wego-system"), LT(Field("spec", "replicas"), Number(2))),
 				Match("Deployment", "bar", Namespace("wego-system"), GT(Field("spec", "replicas"), JoinField("foo", "spec", "replicas")))),
 			Actions(
-				func(args []interface{}) error {
-					foo := args[0]
-					bar := args[1]
-					fmt.Printf("FOO: %#v\n, BAR: %#v\n", foo, bar)
+				func(rc *RuleContext) error {
 					return nil
 				})).Instantiate(args, 0)
 		Expect(err).ShouldNot(HaveOccurred())
-		//		Expect(args.FieldChecks["foo"]).Should(HaveKey("json_extract(NEW.DATA, '$.spec.replicas') <> json_extract(OLD.DATA, '$.spec.replicas')"))
-		//		Expect(args.FieldChecks["bar"]).Should(HaveKey("json_extract(NEW.DATA, '$.spec.replicas') <> json_extract(OLD.DATA, '$.spec.replicas')"))
+		Expect(args.FieldChecks["foo"]).Should(HaveKey("json_extract(NEW.DATA, '$.spec.replicas') IS NOT json_extract(OLD.DATA, '$.spec.replicas')"))
+		Expect(args.FieldChecks["bar"]).Should(HaveKey("json_extract(NEW.DATA, '$.spec.replicas') IS NOT json_extract(OLD.DATA, '$.spec.replicas')"))
+		Expect(args.Queries["foo"].Delete).Should(Equal(fmt.Sprintf("CREATE TRIGGER foo_resources_d_%d BEFORE UPDATE ON resources WHEN NEW.KIND = 'Deployment' AND NEW.IGNORED_UPDATES = OLD.IGNORED_UPDATES AND (json_extract(NEW.DATA, '$.spec.replicas') IS NOT json_extract(OLD.DATA, '$.spec.replicas')) BEGIN DELETE FROM instantiations WHERE ruleNum = %d AND ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = NEW.ID); DELETE FROM justifications WHERE ruleNum = %d AND ID IN (SELECT justification_ID FROM resource_justifications WHERE resource_ID = NEW.ID); END", args.RuleIndex, args.RuleIndex, args.RuleIndex)))
+		Expect(args.Queries["bar"].Delete).Should(BeEmpty())
 		Expect(args.Queries[""].Insert).Should(Equal(fmt.Sprintf("INSERT INTO instantiations (ruleNum, priority, resources) SELECT %d, %d, json_array(foo.ID, bar.ID) FROM resources foo, resources bar WHERE foo.KIND = 'Deployment' AND bar.KIND = 'Deployment' AND ((foo.NAMESPACE = 'wego-system') AND json_extract(foo.DATA, '$.spec.replicas') < 2) AND ((bar.NAMESPACE = 'wego-system') AND json_extract(bar.DATA, '$.spec.replicas') > json_extract(foo.DATA, '$.spec.replicas'))", args.RuleIndex, args.Priority)))
-		Expect(args.Queries["foo"].Insert).Should(Equal(fmt.Sprintf("CREATE TRIGGER foo_resources_%d AFTER INSERT ON resources WHEN NEW.KIND = 'Deployment' BEGIN INSERT INTO instantiations (ruleNum, priority, resources) SELECT %d, %d, json_array(foo.ID, bar.ID) FROM resources foo, resources bar WHERE foo.KIND = 'Deployment' AND bar.KIND = 'Deployment' AND ((foo.NAMESPACE = 'wego-system') AND json_extract(foo.DATA, '$.spec.replicas') < 2) AND ((bar.NAMESPACE = 'wego-system') AND json_extract(bar.DATA, '$.spec.replicas') > json_extract(foo.DATA, '$.spec.replicas')) AND foo.ID = NEW.ID; END", args.RuleIndex, args.RuleIndex, args.Priority)))
-		Expect(args.Queries["bar"].Insert).Should(Equal(fmt.Sprintf("CREATE TRIGGER bar_resources_%d AFTER INSERT ON resources WHEN NEW.KIND = 'Deployment' BEGIN INSERT INTO instantiations (ruleNum, priority, resources) SELECT %d, %d, json_array(foo.ID, bar.ID) FROM resources foo, resources bar WHERE foo.KIND = 'Deployment' AND bar.KIND = 'Deployment' AND ((foo.NAMESPACE = 'wego-system') AND json_extract(foo.DATA, '$.spec.replicas') < 2) AND ((bar.NAMESPACE = 'wego-system') AND json_extract(bar.DATA, '$.spec.replicas') > json_extract(foo.DATA, '$.spec.replicas')) AND bar.ID = NEW.ID; END", args.RuleIndex, args.RuleIndex, args.Priority)))
+		Expect(args.Queries["foo"].Insert).Should(Equal(fmt.Sprintf("CREATE TRIGGER foo_resources_i_%d AFTER INSERT ON resources WHEN NEW.KIND = 'Deployment' BEGIN INSERT INTO instantiations (ruleNum, priority, resources) SELECT %d, %d, json_array(foo.ID, bar.ID) FROM resources foo, resources bar WHERE foo.KIND = 'Deployment' AND bar.KIND = 'Deployment' AND ((foo.NAMESPACE = 'wego-system') AND json_extract(foo.DATA, '$.spec.replicas') < 2) AND ((bar.NAMESPACE = 'wego-system') AND json_extract(bar.DATA, '$.spec.replicas') > json_extract(foo.DATA, '$.spec.replicas')) AND foo.ID = NEW.ID; END", args.RuleIndex, args.RuleIndex, args.Priority)))
+		Expect(args.Queries["bar"].Insert).Should(Equal(fmt.Sprintf("CREATE TRIGGER bar_resources_i_%d AFTER INSERT ON resources WHEN NEW.KIND = 'Deployment' BEGIN INSERT INTO instantiations (ruleNum, priority, resources) SELECT %d, %d, json_array(foo.ID, bar.ID) FROM resources foo, resources bar WHERE foo.KIND = 'Deployment' AND bar.KIND = 'Deployment' AND ((foo.NAMESPACE = 'wego-system') AND json_extract(foo.DATA, '$.spec.replicas') < 2) AND ((bar.NAMESPACE = 'wego-system') AND json_extract(bar.DATA, '$.spec.replicas') > json_extract(foo.DATA, '$.spec.replicas')) AND bar.ID = NEW.ID; END", args.RuleIndex, args.RuleIndex, args.Priority)))
 	})
 
 	It("processes an instantiation result set", func() {
@@ -312,7 +320,7 @@ var _ = Describe("Rule Tests", func() {
 		connections, err := getResourceInstantiationConnections(e.DB)
 		Expect(err).ShouldNot(HaveOccurred())
 		Expect(len(connections)).To(Equal(2))
-		err = e.AddResourceStringList([]string{`{"kind": "Ball", "namespace": "test", "name": "foo", "color": "red", "size": 10}`})
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
 		Expect(err).ShouldNot(HaveOccurred())
 		r, err := e.GetResource("Ball", "foo", "test")
 		Expect(err).ShouldNot(HaveOccurred())
@@ -320,15 +328,2044 @@ var _ = Describe("Rule Tests", func() {
 		err = json.Unmarshal([]byte(r), &m)
 		Expect(err).ShouldNot(HaveOccurred())
 		Expect(m["color"]).To(Equal("red"))
+		// No rule refers to the ball's fields, so its instantiation survives.
 		connections, err = getResourceInstantiationConnections(e.DB)
 		Expect(err).ShouldNot(HaveOccurred())
-		Expect(len(connections)).To(Equal(0))
-		err = e.AddResourceStringList([]string{`{"kind": "Ball", "namespace": "test", "name": "foo", "color": "reddish", "size": 10}`})
+		Expect(len(connections)).To(Equal(2))
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "reddish", "size": 10}`})
+		r, err = e.GetResource("Ball", "foo", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = json.Unmarshal([]byte(r), &m)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(m["color"]).To(Equal("reddish"))
+	})
+})
+
+type testCube struct {
+	CubeName string `json:"name"`
+	Size     int64  `json:"size"`
+}
+
+func (c *testCube) Kind() string {
+	return "Cube"
+}
+
+func (c *testCube) Name() string {
+	return c.CubeName
+}
+
+var _ = Describe("Rule Context Tests", func() {
+	It("adds structs, maps and raw JSON from actions", func() {
+		var addErr, keyErr error
+
+		RuleSet(
+			"context-add",
+			Rule(Name("add-all"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						if err := c.Add(&testCube{CubeName: "struct-cube", Size: 1}); err != nil {
+							return err
+						}
+
+						if err := c.Add(map[string]interface{}{"kind": "Cube", "metadata": map[string]interface{}{"name": "map-cube", "namespace": "test"}, "size": 2}); err != nil {
+							return err
+						}
+
+						if err := c.Add(json.RawMessage(`{"kind": "Cube", "metadata": {"name": "raw-cube", "namespace": "test"}, "size": 3}`)); err != nil {
+							return err
+						}
+
+						if err := c.Add([]byte(`{"kind": "Cube", "metadata": {"name": "bytes-cube", "namespace": "test"}, "size": 4}`)); err != nil {
+							return err
+						}
+
+						addErr = c.Add(42)
+						keyErr = c.Add(map[string]interface{}{"kind": "Cube", "size": 5})
+
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-add", "context-add")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(addErr).To(MatchError("unsupported resource type: int"))
+		Expect(errors.Is(addErr, ErrResourceType)).To(BeTrue())
+		Expect(errors.Is(keyErr, ErrBadPath)).To(BeTrue())
+
+		r, err := e.GetResource("Cube", "struct-cube", "")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"name": "struct-cube", "size": 1}`))
+
+		for name, size := range map[string]int{"map-cube": 2, "raw-cube": 3, "bytes-cube": 4} {
+			r, err := e.GetResource("Cube", name, "test")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(r).To(MatchJSON(fmt.Sprintf(`{"kind": "Cube", "metadata": {"name": "%s", "namespace": "test"}, "size": %d}`, name, size)))
+		}
+	})
+
+	It("adds structs from actions on a Kubernetes engine", func() {
+		RuleSet(
+			"context-add-k8s",
+			Rule(Name("add-struct"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						return c.Add(&testCube{CubeName: "k8s-cube", Size: 1})
+					})))
+
+		e, err := NewK8sEngine("file:context-add-k8s?mode=memory&cache=shared", "context-add-k8s")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		r, err := e.GetResource("Cube", "k8s-cube", "")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"name": "k8s-cube", "size": 1}`))
+	})
+
+	It("queries and updates other resources from actions", func() {
+		var names []string
+
+		RuleSet(
+			"context-query",
+			Rule(Name("grow-cubes"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						cubes, err := c.Query("Cube", GT(Field("size"), JoinField("ball", "size")), NEQ(Field("color"), String("green")))
+						if err != nil {
+							return err
+						}
+
+						for _, cube := range cubes {
+							name, err := cube.Get(Field("metadata", "name"))
+							if err != nil {
+								return err
+							}
+
+							names = append(names, name.(string))
+						}
+
+						cube, err := c.Get("Cube", "quux", "test")
+						if err != nil {
+							return err
+						}
+
+						if err := c.Set(cube, Field("size"), 5); err != nil {
+							return err
+						}
+
+						return c.Add(cube)
+					})))
+
+		e, err := newMemoryEngine("context-query", "context-query")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+			`{"kind": "Cube", "metadata": {"namespace": "test", "name": "baz"}, "color": "blue", "size": 30}`,
+			`{"kind": "Cube", "metadata": {"namespace": "test", "name": "quux"}, "color": "green", "size": 20}`,
+			`{"kind": "Cube", "metadata": {"namespace": "test", "name": "razz"}, "color": "red", "size": 5}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(names).To(Equal([]string{"baz"}))
+
+		r, err := e.GetResource("Cube", "quux", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Cube", "metadata": {"namespace": "test", "name": "quux"}, "color": "green", "size": 5}`))
+	})
+
+	It("retracts logical resources when their justifications disappear", func() {
+		RuleSet(
+			"context-logical",
+			Rule(Name("derive"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("color"), String("red"))),
+					Match("Gurk", "gurk", EQ(Field("size"), JoinField("ball", "size")))),
+				Actions(
+					func(c *RuleContext) error {
+						return c.AddLogical(`{"kind": "Derived", "metadata": {"namespace": "test", "name": "derived"}}`)
+					})))
+
+		e, err := newMemoryEngine("context-logical", "context-logical")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red", "size": 10}`,
+			`{"kind": "Gurk", "metadata": {"namespace": "test", "name": "gurk"}, "size": 10}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "blue", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var id int
+		Expect(e.DB.QueryRow("SELECT ID FROM resources WHERE KIND = 'Ball' AND NAME = 'bar'").Scan(&id)).To(Succeed())
+		Expect(deleteResource(e.DB, id)).To(Succeed())
+
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).To(Equal(sql.ErrNoRows))
+
+		var count int
+		Expect(e.DB.QueryRow("SELECT count(*) FROM resource_justifications").Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(0))
+	})
+
+	It("keeps stated resources that are also added logically", func() {
+		RuleSet(
+			"context-logical-stated",
+			Rule(Name("flag"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						return c.AddLogical(`{"kind": "Flag", "metadata": {"namespace": "test", "name": "f"}}`)
+					})))
+
+		e, err := newMemoryEngine("context-logical-stated", "context-logical-stated")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Flag", "metadata": {"namespace": "test", "name": "f"}}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "blue", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		_, err = e.GetResource("Flag", "f", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// Stating a logical resource takes it out of truth maintenance too.
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.DeleteResource("Flag", "f", "test")).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		err = e.AddResourceStringList([]string{`{"kind": "Flag", "metadata": {"namespace": "test", "name": "f"}}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "blue", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		_, err = e.GetResource("Flag", "f", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("fires agenda groups in focus order and halts on request", func() {
+		fired := []string{}
+
+		record := func(name string) ActionFunc {
+			return func(c *RuleContext) error {
+				fired = append(fired, name)
+				return nil
+			}
+		}
+
+		RuleSet(
+			"context-focus",
+			Rule(Name("report"), Group("report"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("report"))),
+			Rule(Name("mutate"), Group("mutate"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						fired = append(fired, "mutate")
+						c.SetFocus("validate")
+						return nil
+					})),
+			Rule(Name("validate"), Group("validate"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("validate"))),
+			Rule(Name("stop"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("blue")))),
+				Actions(
+					func(c *RuleContext) error {
+						fired = append(fired, "stop")
+						c.Halt()
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-focus", "context-focus")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "blue", "size": 10}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "baz"}, "color": "blue", "size": 10}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		e.SetFocus("report")
+		e.SetFocus("mutate")
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"mutate", "validate", "report", "stop"}))
+		Expect(e.Focus()).To(Equal(""))
+
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"mutate", "validate", "report", "stop", "stop"}))
+	})
+
+	It("delivers emitted effects only after the firing commits", func() {
+		failures := 1
+
+		RuleSet(
+			"context-emit",
+			Rule(Name("notify"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						if err := c.Emit(Effect{Kind: "notify", Key: "notify-" + name, Payload: map[string]string{"ball": name}}); err != nil {
+							return err
+						}
+
+						if failures > 0 {
+							failures--
+							return fmt.Errorf("external failure")
+						}
+
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-emit", "context-emit")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+
+		effects, err := e.PendingEffects()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(effects).To(HaveLen(1))
+		Expect(effects[0].Key).To(Equal("notify-foo"))
+		Expect(effects[0].Payload).To(MatchJSON(`{"ball": "foo"}`))
+
+		count, err := e.Dispatch(func(effect Effect) error { return fmt.Errorf("unavailable") })
+		Expect(err).To(MatchError("unavailable"))
+		Expect(count).To(Equal(0))
+
+		delivered := []string{}
+		count, err = e.Dispatch(func(effect Effect) error {
+			Expect(effect.Attempts).To(Equal(2))
+			delivered = append(delivered, effect.Key)
+			return nil
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(count).To(Equal(1))
+		Expect(delivered).To(Equal([]string{"notify-foo"}))
+
+		e.SetDispatcher(func(effect Effect) error {
+			delivered = append(delivered, effect.Key)
+			return nil
+		})
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(delivered).To(Equal([]string{"notify-foo", "notify-bar"}))
+
+		effects, err = e.PendingEffects()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(effects).To(BeEmpty())
+	})
+
+	It("delivers each keyed effect once, outside the engine lock", func() {
+		var keyErr error
+
+		RuleSet(
+			"context-emit-once",
+			Rule(Name("notify"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						if err := c.Emit(Effect{Kind: "notify", Key: "notify-once", Payload: map[string]string{"ball": "any"}}); err != nil {
+							return err
+						}
+
+						keyErr = c.Emit(Effect{Kind: "notify", Key: "notify-once", Payload: map[string]string{"ball": "other"}})
+
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-emit-once", "context-emit-once")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		delivered := []string{}
+		e.SetDispatcher(func(effect Effect) error {
+			delivered = append(delivered, effect.Key)
+
+			// Dispatchers may call back into the engine.
+			return e.AddResourceStringList([]string{`{"kind": "Receipt", "metadata": {"namespace": "test", "name": "receipt"}}`})
+		})
+
+		for _, name := range []string{"foo", "bar"} {
+			err = e.AddResourceStringList([]string{fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "%s"}, "color": "red"}`, name)})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(e.Run()).To(Succeed())
+		}
+
+		Expect(errors.Is(keyErr, ErrEffectKey)).To(BeTrue())
+		Expect(delivered).To(Equal([]string{"notify-once"}))
+
+		_, err = e.GetResource("Receipt", "receipt", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var dispatchErr error
+		e.SetDispatchErrorHandler(func(err error) { dispatchErr = err })
+		e.SetDispatcher(func(effect Effect) error { return fmt.Errorf("unavailable") })
+
+		forgotten, err := e.ForgetDeliveredEffects(time.Now().Add(time.Hour))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(forgotten).To(Equal(int64(1)))
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "baz"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(dispatchErr).To(MatchError("unavailable"))
+
+		effects, err := e.PendingEffects()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(effects).To(HaveLen(1))
+	})
+
+	It("parks failing instantiations and dead-letters them", func() {
+		attempts := map[string]int{}
+
+		RuleSet(
+			"context-retry",
+			Rule(Name("flaky"),
+				OnError(ErrorPolicy{MaxAttempts: 2, Backoff: func(int) time.Duration { return time.Minute }}),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						attempts[name]++
+
+						if name == "bad" {
+							return fmt.Errorf("cannot handle %s", name)
+						}
+
+						return nil
+					})))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-retry", "context-retry")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bad"}, "color": "red"}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "good"}, "color": "red"}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(e.Run()).To(Succeed())
+		Expect(attempts).To(Equal(map[string]int{"bad": 1, "good": 1}))
+
+		_, parked, err := e.NextRetry(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(parked).To(BeTrue())
+
+		Expect(e.Run()).To(Succeed())
+		Expect(attempts["bad"]).To(Equal(1))
+
+		clock.Advance(time.Minute)
+		Expect(e.Run()).To(Succeed())
+		Expect(attempts["bad"]).To(Equal(2))
+
+		_, parked, err = e.NextRetry(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(parked).To(BeFalse())
+
+		letters, err := e.DeadLetters()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(letters).To(HaveLen(1))
+		Expect(letters[0].Rule).To(Equal("flaky"))
+		Expect(letters[0].Attempts).To(Equal(2))
+		Expect(letters[0].Error).To(Equal("cannot handle bad"))
+	})
+
+	It("applies the default attempt limit to a zero error policy", func() {
+		attempts := 0
+
+		RuleSet(
+			"context-retry-zero",
+			Rule(Name("broken"),
+				OnError(ErrorPolicy{}),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						attempts++
+						return errors.New("broken")
+					})))
+
+		e, err := newMemoryEngine("context-retry-zero", "context-retry-zero")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(e.Run()).To(Succeed())
+		Expect(attempts).To(Equal(DefaultErrorPolicy.MaxAttempts))
+
+		letters, err := e.DeadLetters()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(letters).To(HaveLen(1))
+	})
+
+	It("reports typed errors", func() {
+		_, err := newMemoryEngine("context-errors-missing", "context-errors-missing")
+		Expect(errors.Is(err, ErrNoSuchRuleSet)).To(BeTrue())
+
+		RuleSet(
+			"context-errors",
+			Rule(Name("broken"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						_, err := c.GetIntField("nosuchball", Field("size"), 0)
+						return err
+					})))
+
+		e, err := newMemoryEngine("context-errors", "context-errors")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		firing, err := e.Step()
+		Expect(errors.Is(err, ErrUnknownObject)).To(BeTrue())
+
+		var actionErr *ActionError
+		Expect(errors.As(err, &actionErr)).To(BeTrue())
+		Expect(actionErr.Rule).To(Equal("broken"))
+		Expect(actionErr.InstantiationID).To(Equal(firing.InstantiationID))
+		Expect(actionErr.Resources).To(Equal(firing.Resources))
+		Expect(err).To(MatchError("rule broken failed for resources [1]: unknown object: nosuchball"))
+
+		fr := &FetchedResource{raw: `{"color": "red"}`}
+		_, err = fr.Get(Field("color", "0"))
+		Expect(errors.Is(err, ErrBadPath)).To(BeTrue())
+
+		err = e.ApplyInTransaction([]string{"DELETE FROM nosuchtable"})
+		Expect(errors.Is(err, ErrStorage)).To(BeTrue())
+
+		var storageErr *StorageError
+		Expect(errors.As(err, &storageErr)).To(BeTrue())
+		Expect(err).To(MatchError("no such table: nosuchtable"))
+
+		_, err = e.GetResource("Ball", "nosuchball", "test")
+		Expect(err).To(Equal(sql.ErrNoRows))
+	})
+
+	It("reports a dry run without changing working memory", func() {
+		RuleSet(
+			"context-dryrun",
+			Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						if name == "bad" {
+							return fmt.Errorf("cannot paint %s", name)
+						}
+
+						if err := c.UpdateField("ball", Field("size"), int64(20)); err != nil {
+							return err
+						}
+
+						return c.Add(&testCube{CubeName: name, Size: 20})
+					})))
+
+		e, err := newMemoryEngine("context-dryrun", "context-dryrun")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bad"}, "color": "red", "size": 10}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		report, err := e.DryRun(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(report.Halted).To(BeFalse())
+		Expect(report.Firings).To(HaveLen(2))
+
+		Expect(report.Firings[0].Rule).To(Equal("paint"))
+		Expect(report.Firings[0].Err).To(MatchError(ContainSubstring("cannot paint bad")))
+		Expect(report.Firings[0].Changes).To(BeEmpty())
+
+		changes := report.Firings[1].Changes
+		Expect(report.Firings[1].Err).ShouldNot(HaveOccurred())
+		Expect(changes).To(HaveLen(2))
+		Expect(changes[0].Op).To(Equal("modified"))
+		Expect(changes[0].Name).To(Equal("foo"))
+		Expect(changes[0].Before).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`))
+		Expect(changes[0].After).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 20}`))
+		Expect(changes[1].Op).To(Equal("added"))
+		Expect(changes[1].Kind).To(Equal("Cube"))
+		Expect(changes[1].Before).To(BeNil())
+
+		r, err := e.GetResource("Ball", "foo", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`))
+
+		Expect(e.Run()).To(Succeed())
 		r, err = e.GetResource("Ball", "foo", "test")
 		Expect(err).ShouldNot(HaveOccurred())
-		err = json.Unmarshal([]byte(r), &m)
+		Expect(r).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 20}`))
+	})
+
+	It("applies firing limits in a dry run as a run would", func() {
+		RuleSet(
+			"context-dryrun-limit",
+			Rule(Name("loop"), MaxFirings(3),
+				Conditions(Match("Deployment", "dep", LT(Field("spec", "replicas"), Number(1000)))),
+				Actions(
+					func(c *RuleContext) error {
+						replicas, err := c.GetIntField("dep", Field("spec", "replicas"), 0)
+						if err != nil {
+							return err
+						}
+
+						return c.UpdateField("dep", Field("spec", "replicas"), replicas+1)
+					})))
+
+		e, err := newMemoryEngine("context-dryrun-limit", "context-dryrun-limit")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 0}}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		report, err := e.DryRun(ctx)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(report.Firings).To(HaveLen(4))
+		Expect(report.Firings[2].Err).ShouldNot(HaveOccurred())
+
+		var limitErr *FiringLimitError
+		Expect(errors.As(report.Firings[3].Err, &limitErr)).To(BeTrue())
+		Expect(report.Firings[3].Changes).To(BeEmpty())
+
+		fired, err := e.RunN(10)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fired).To(Equal(3))
+	})
+
+	It("leaves expiry out of the changes of a dry run firing", func() {
+		RuleSet(
+			"context-dryrun-expiry",
+			Rule(Name("r"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						return c.UpdateField("ball", Field("size"), int64(20))
+					})))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-dryrun-expiry", "context-dryrun-expiry")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+		Expect(e.AddResourceWithTTL(`{"kind": "Cube", "metadata": {"namespace": "test", "name": "c"}}`, time.Minute)).To(Succeed())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		clock.Advance(time.Minute)
+
+		report, err := e.DryRun(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(report.Firings).To(HaveLen(1))
+		Expect(report.Firings[0].Changes).To(HaveLen(1))
+		Expect(report.Firings[0].Changes[0].Kind).To(Equal("Ball"))
+	})
+
+	It("keeps engines and registries isolated", func() {
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-isolated",
+			Rule(Name("count"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						return c.Add(&testCube{CubeName: "counted"})
+					})))
+
+		_, err := NewEngine("", "context-isolated")
+		Expect(errors.Is(err, ErrNoSuchRuleSet)).To(BeTrue())
+
+		e1, err := registry.NewEngine("", "context-isolated")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer e1.Close()
+
+		e2, err := registry.NewEngine("", "context-isolated")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		err = e1.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e1.Run()).To(Succeed())
+		Expect(e2.Run()).To(Succeed())
+
+		_, err = e1.GetResource("Cube", "counted", "")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = e2.GetResource("Ball", "foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+
+		Expect(e2.Close()).To(Succeed())
+		Expect(e2.Run()).To(HaveOccurred())
+	})
+
+	It("removes and replaces rule sets at runtime", func() {
+		fired := []string{}
+
+		record := func(label string) ActionFunc {
+			return func(c *RuleContext) error {
+				name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+				if err != nil {
+					return err
+				}
+
+				fired = append(fired, label+":"+name)
+				return nil
+			}
+		}
+
+		RuleSet(
+			"context-reload",
+			Rule(Name("red"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("red"))))
+
+		e, err := newMemoryEngine("context-reload", "context-reload")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "blue", "size": 20}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		err = e.ReplaceRuleSet("context-reload",
+			Rule(Name("big"),
+				Conditions(Match("Ball", "ball", GT(Field("size"), Number(15)))),
+				Actions(record("big"))))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"big:bar"}))
+
+		var triggers int
+		err = e.DB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'ball_resources_%_0'").Scan(&triggers)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(triggers).To(Equal(0))
+
+		Expect(e.RemoveRuleSet("context-reload")).To(Succeed())
+		Expect(e.RuleSets).To(BeEmpty())
+		Expect(e.Rules).To(BeEmpty())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "baz"}, "color": "red", "size": 30}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"big:bar"}))
+
+		Expect(errors.Is(e.RemoveRuleSet("context-reload"), ErrNoSuchRuleSet)).To(BeTrue())
+	})
+
+	It("disables and enables rules", func() {
+		fired := []string{}
+
+		RuleSet(
+			"context-disable",
+			Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						fired = append(fired, name)
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-disable", "context-disable")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(e.DisableRule("paint")).To(Succeed())
+		enabled, err := e.RuleEnabled("paint")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(enabled).To(BeFalse())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(BeEmpty())
+
+		// The setting survives reinstalling the rule.
+		Expect(e.RemoveRuleSet("context-disable")).To(Succeed())
+		Expect(e.AddRuleSet("context-disable")).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(BeEmpty())
+
+		Expect(e.EnableRule("paint")).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(ConsistOf("foo", "bar"))
+
+		Expect(errors.Is(e.DisableRule("nosuchrule"), ErrNoSuchRule)).To(BeTrue())
+	})
+
+	It("disables every rule sharing a name across rule sets", func() {
+		fired := []string{}
+
+		record := func(label string) ActionFunc {
+			return func(c *RuleContext) error {
+				fired = append(fired, label)
+				return nil
+			}
+		}
+
+		RuleSet(
+			"context-disable-one",
+			Rule(Name("shared"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("one"))))
+		RuleSet(
+			"context-disable-two",
+			Rule(Name("shared"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("two"))))
+
+		e, err := newMemoryEngine("context-disable-shared", "context-disable-one", "context-disable-two")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.DisableRule("shared")).To(Succeed())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(BeEmpty())
+
+		Expect(e.EnableRule("shared")).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(ConsistOf("one", "two"))
+	})
+
+	It("fires timer rules from the engine clock", func() {
+		var lock sync.Mutex
+		fired := []string{}
+
+		record := func(label string) ActionFunc {
+			return func(c *RuleContext) error {
+				lock.Lock()
+				defer lock.Unlock()
+
+				fired = append(fired, label)
+				return nil
+			}
+		}
+
+		RuleSet(
+			"context-timers",
+			Rule(Name("after"),
+				After(10*time.Second),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("after"))),
+			Rule(Name("every"),
+				Every(time.Minute),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(record("every"))),
+			Rule(Name("deadline"),
+				Deadline("job", Field("spec", "deadline")),
+				Conditions(Match("Job", "job", EQ(Field("status"), String("running")))),
+				Actions(record("deadline"))))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-timers", "context-timers")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`,
+			`{"kind": "Job", "metadata": {"namespace": "test", "name": "job"}, "status": "running", "spec": {"deadline": "2026-01-01T00:05:00Z"}}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"every"}))
+
+		clock.Advance(11 * time.Second)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"every", "after"}))
+
+		clock.Advance(time.Minute)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"every", "after", "every"}))
+
+		// Breaking the match stops the periodic rule.
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "blue"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() { done <- e.Serve(ctx) }()
+
+		Eventually(func() error { return e.WaitIdle(ctx) }).Should(Succeed())
+		clock.Advance(5 * time.Minute)
+		Eventually(func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(fired)
+		}).Should(Equal(4))
+
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+		Expect(fired).To(Equal([]string{"every", "after", "every", "deadline"}))
+	})
+
+	It("rejects a Deadline that names no match", func() {
+		RuleSet(
+			"context-deadline-unknown",
+			Rule(Name("deadline"),
+				Deadline("jobs", Field("spec", "deadline")),
+				Conditions(Match("Job", "job", EQ(Field("status"), String("running")))),
+				Actions(func(c *RuleContext) error { return nil })))
+
+		_, err := newMemoryEngine("context-deadline-unknown", "context-deadline-unknown")
+		Expect(errors.Is(err, ErrUnknownObject)).To(BeTrue())
+	})
+
+	It("times After rules from when the match was made", func() {
+		fired := 0
+
+		RuleSet(
+			"context-after-match",
+			Rule(Name("after"),
+				After(10*time.Second),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(func(c *RuleContext) error {
+					fired++
+					return nil
+				})))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-after-match", "context-after-match")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// The agenda is first looked at well after the match was made.
+		clock.Advance(6 * time.Second)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(0))
+
+		clock.Advance(5 * time.Second)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(1))
+	})
+
+	It("expires resources after their time to live", func() {
+		expired := []string{}
+
+		RuleSet(
+			"context-ttl",
+			Rule(Name("healthy"),
+				Conditions(Match("Probe", "probe", EQ(Field("status"), String("ok")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("probe", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						return c.AddLogical(fmt.Sprintf(`{"kind": "Healthy", "metadata": {"namespace": "test", "name": "%s"}}`, name))
+					})),
+			Rule(Name("expired"),
+				Conditions(Match(ExpiredKind, "event", EQ(Field("resource", "kind"), String("Probe")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("event", Field("resource", "metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						expired = append(expired, name)
+						return nil
+					})))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-ttl", "context-ttl")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+		e.SetTTL("Probe", time.Minute)
+
+		probe := func(name string) string {
+			return fmt.Sprintf(`{"kind": "Probe", "metadata": {"namespace": "test", "name": "%s"}, "status": "ok"}`, name)
+		}
+
+		Expect(e.AddResourceStringList([]string{probe("foo")})).To(Succeed())
+		Expect(e.AddResourceWithTTL(probe("bar"), 10*time.Minute)).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+
+		_, err = e.GetResource("Healthy", "foo", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// Re-adding an unchanged resource renews its time to live.
+		clock.Advance(50 * time.Second)
+		Expect(e.AddResourceStringList([]string{probe("foo")})).To(Succeed())
+		clock.Advance(50 * time.Second)
+		Expect(e.Run()).To(Succeed())
+		Expect(expired).To(BeEmpty())
+
+		clock.Advance(time.Minute)
+		Expect(e.Run()).To(Succeed())
+		Expect(expired).To(Equal([]string{"foo"}))
+
+		_, err = e.GetResource("Probe", "foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+		_, err = e.GetResource("Healthy", "foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+		_, err = e.GetResource(ExpiredKind, "Probe.foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+
+		_, err = e.GetResource("Healthy", "bar", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("hides expired resources from actions and keeps callers' Expired resources", func() {
+		var getErr error
+		var queried []*FetchedResource
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		RuleSet(
+			"context-ttl-lookup",
+			Rule(Name("lookup"),
+				Conditions(Match("Check", "request", EQ(Field("metadata", "name"), String("check")))),
+				Actions(
+					func(c *RuleContext) error {
+						// The probe expires while the action runs.
+						clock.Advance(2 * time.Minute)
+
+						_, getErr = c.Get("Probe", "foo", "test")
+
+						var err error
+						queried, err = c.Query("Probe")
+						return err
+					})),
+			Rule(Name("expired"),
+				Conditions(Match(ExpiredKind, "event", EQ(Field("resource", "kind"), String("Probe")))),
+				Actions(func(c *RuleContext) error { return nil })))
+
+		e, err := newMemoryEngine("context-ttl-lookup", "context-ttl-lookup")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+
+		Expect(e.AddResourceWithTTL(`{"kind": "Probe", "metadata": {"namespace": "test", "name": "foo"}}`, time.Minute)).To(Succeed())
+		Expect(e.AddResourceStringList([]string{
+			`{"kind": "Expired", "metadata": {"namespace": "test", "name": "mine"}}`,
+			`{"kind": "Expired", "metadata": {"namespace": "test", "name": "Cube.c"}, "owner": "caller"}`,
+			`{"kind": "Check", "metadata": {"namespace": "test", "name": "check"}}`,
+		})).To(Succeed())
+		Expect(e.AddResourceWithTTL(`{"kind": "Cube", "metadata": {"namespace": "test", "name": "c"}}`, time.Minute)).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+
+		Expect(getErr).To(MatchError(sql.ErrNoRows))
+		Expect(queried).To(BeEmpty())
+
+		_, err = e.GetResource(ExpiredKind, "Probe.foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+		_, err = e.GetResource(ExpiredKind, "mine", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// The caller's resource named like the cube's expiry event survives
+		// the cube expiring.
+		Expect(e.Run()).To(Succeed())
+		r, err := e.GetResource(ExpiredKind, "Cube.c", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Expired", "metadata": {"namespace": "test", "name": "Cube.c"}, "owner": "caller"}`))
+	})
+
+	It("keeps expiry events that parked instantiations still need", func() {
+		fired := []string{}
+
+		RuleSet(
+			"context-ttl-parked",
+			Rule(Name("expired"),
+				After(time.Minute),
+				Conditions(Match(ExpiredKind, "event", EQ(Field("resource", "kind"), String("Probe")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("event", Field("resource", "metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						fired = append(fired, name)
+						return nil
+					})))
+
+		clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		e, err := newMemoryEngine("context-ttl-parked", "context-ttl-parked")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.Clock = clock
+
+		Expect(e.AddResourceWithTTL(`{"kind": "Probe", "metadata": {"namespace": "test", "name": "foo"}}`, time.Minute)).To(Succeed())
+		clock.Advance(time.Minute)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(BeEmpty())
+
+		clock.Advance(time.Minute)
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"foo"}))
+
+		_, err = e.GetResource(ExpiredKind, "Probe.foo", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+	})
+
+	It("reopens persistent databases and migrates old layouts", func() {
+		dir, err := os.MkdirTemp("", "gorules")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		fired := []string{}
+
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-reopen",
+			Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						fired = append(fired, name)
+						return nil
+					})))
+
+		path := fmt.Sprintf("file:%s/reopen.db", dir)
+
+		e, err := registry.NewEngine(path, "context-reopen")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red"}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = e.RunN(1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Close()).To(Succeed())
+
+		// The unchanged rule keeps its pending instantiation and does not
+		// fire again for the resource it already handled.
+		e, err = registry.NewEngine(path, "context-reopen")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(ConsistOf("foo", "bar"))
+
+		var version int
+		Expect(e.DB.QueryRow("SELECT val FROM configuration WHERE name = 'schema_version'").Scan(&version)).To(Succeed())
+		Expect(version).To(Equal(schemaVersion))
+		Expect(e.Close()).To(Succeed())
+
+		legacy, err := sql.Open("sqlite3", fmt.Sprintf("file:%s/legacy.db", dir))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		for _, stmt := range schemaStatements(legacySchema) {
+			_, err := legacy.Exec(stmt)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+
+		_, err = legacy.Exec(`INSERT INTO resources (KIND, NAME, NAMESPACE, DATA) VALUES ('Ball', 'old', 'test', '{"kind": "Ball", "metadata": {"namespace": "test", "name": "old"}, "color": "red"}')`)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(legacy.Close()).To(Succeed())
+
+		fired = nil
+		e, err = registry.NewEngine(fmt.Sprintf("file:%s/legacy.db", dir), "context-reopen")
 		Expect(err).ShouldNot(HaveOccurred())
-		Expect(m["color"]).To(Equal("reddish"))
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"old"}))
+
+		_, err = e.DB.Exec("UPDATE configuration SET val = 99 WHERE name = 'schema_version'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Close()).To(Succeed())
+
+		_, err = registry.NewEngine(fmt.Sprintf("file:%s/legacy.db", dir), "context-reopen")
+		Expect(errors.Is(err, ErrSchemaVersion)).To(BeTrue())
+	})
+
+	It("snapshots and restores working memory and the agenda", func() {
+		fired := []string{}
+
+		RuleSet(
+			"context-snapshot",
+			Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						fired = append(fired, name)
+						return nil
+					})))
+
+		e, err := NewEngine("", "context-snapshot")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer e.Close()
+
+		err = e.AddResourceStringList([]string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red"}`,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.AddResourceWithTTL(`{"kind": "Probe", "metadata": {"namespace": "test", "name": "probe"}}`, time.Hour)).To(Succeed())
+		_, err = e.RunN(1)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var snapshot bytes.Buffer
+		Expect(e.Snapshot(&snapshot)).To(Succeed())
+
+		restored, err := NewEngine("", "context-snapshot")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer restored.Close()
+
+		err = restored.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "stale"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(restored.Restore(&snapshot)).To(Succeed())
+
+		_, err = restored.GetResource("Ball", "stale", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+		r, err := restored.GetResource("Ball", "bar", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "red"}`))
+
+		var expires, restoredExpires int64
+		Expect(e.DB.QueryRow("SELECT EXPIRES_AT FROM resources WHERE KIND = 'Probe'").Scan(&expires)).To(Succeed())
+		Expect(restored.DB.QueryRow("SELECT EXPIRES_AT FROM resources WHERE KIND = 'Probe'").Scan(&restoredExpires)).To(Succeed())
+		Expect(restoredExpires).To(Equal(expires))
+
+		Expect(restored.Run()).To(Succeed())
+		Expect(fired).To(HaveLen(2))
+		Expect(fired[0]).NotTo(Equal(fired[1]))
+
+		_, err = restored.DB.Exec("DELETE FROM resources")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(restored.Restore(strings.NewReader(`{"version": 99}`))).To(MatchError(ErrSchemaVersion))
+		Expect(restored.Restore(strings.NewReader(`{"version": 2}`))).To(MatchError(ErrSchemaVersion))
+		Expect(restored.Restore(strings.NewReader(`{"version": 3}
+{"table": "sqlite_master", "row": {}}`))).To(MatchError(ErrSnapshotFormat))
+		Expect(restored.Restore(strings.NewReader(`{"version": 3}
+{"table": "resources", "row": {"DATA) VALUES (1); --": 1}}`))).To(MatchError(ErrSnapshotFormat))
+	})
+
+	It("re-associates pending instantiations with their rules on reopen", func() {
+		dir, err := os.MkdirTemp("", "gorules")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		fired := []string{}
+
+		paint := func(color string) *RuleVal {
+			return Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String(color)))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						fired = append(fired, "paint:"+name)
+						return nil
+					}))
+		}
+
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-identity-other",
+			Rule(Name("count"),
+				Conditions(Match("Box", "box", EQ(Field("size"), Number(1)))),
+				Actions(func(c *RuleContext) error { return nil })))
+		registry.RuleSet("context-identity", paint("red"))
+
+		path := fmt.Sprintf("file:%s/identity.db", dir)
+
+		e, err := registry.NewEngine(path, "context-identity")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})).To(Succeed())
+		Expect(e.Close()).To(Succeed())
+
+		// The unchanged rule now has a different index but keeps its
+		// pending instantiation.
+		e, err = registry.NewEngine(path, "context-identity-other", "context-identity")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.RuleNameToIndex["paint"]).To(Equal(1))
+
+		var pending int
+		Expect(e.DB.QueryRow("SELECT count(*) FROM instantiations WHERE ruleNum = 1").Scan(&pending)).To(Succeed())
+		Expect(pending).To(Equal(1))
+
+		Expect(e.Close()).To(Succeed())
+
+		// A rule whose conditions changed does not inherit the old rule's
+		// agenda; it is matched afresh.
+		registry.RuleSet("context-identity", paint("blue"))
+		e, err = registry.NewEngine(path, "context-identity")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(BeEmpty())
+
+		Expect(e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "bar"}, "color": "blue"}`})).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"paint:bar"}))
+		Expect(e.Close()).To(Succeed())
+
+		// Switching back matches the resource afresh.
+		registry.RuleSet("context-identity", paint("red"))
+		e, err = registry.NewEngine(path, "context-identity-other", "context-identity")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal([]string{"paint:bar", "paint:foo"}))
+		Expect(e.Close()).To(Succeed())
+	})
+
+	It("keeps the copies of a duplicated rule set apart on reopen", func() {
+		dir, err := os.MkdirTemp("", "gorules")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		fired := []int{}
+
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-identity-dup",
+			Rule(Name("paint"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						fired = append(fired, c.ruleNum)
+						return nil
+					})))
+
+		path := fmt.Sprintf("file:%s/identity-dup.db", dir)
+
+		e, err := registry.NewEngine(path, "context-identity-dup", "context-identity-dup")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})).To(Succeed())
+
+		var identities int
+		Expect(e.DB.QueryRow("SELECT count(DISTINCT identity) FROM rules").Scan(&identities)).To(Succeed())
+		Expect(identities).To(Equal(2))
+
+		firing, err := e.Step()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Close()).To(Succeed())
+
+		// Only the copy that has not fired yet still has work to do.
+		e, err = registry.NewEngine(path, "context-identity-dup", "context-identity-dup")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(HaveLen(2))
+		Expect(fired[1]).To(Equal(1 - firing.RuleIndex))
+		Expect(e.Close()).To(Succeed())
+	})
+
+	It("bulk loads resources with the same agenda as incremental inserts", func() {
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-bulk",
+			Rule(Name("pair"),
+				Conditions(
+					Match("Ball", "ball", EQ(Field("pattern"), String("stripe"))),
+					Match("Ball", "other", EQ(Field("pattern"), String("solid")), EQ(JoinField("ball", "color"), Field("color"))))),
+			Rule(Name("big"),
+				Conditions(Match("Ball", "ball", GT(Field("value"), Number(5))))))
+
+		existing := []string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "a"}, "pattern": "stripe", "color": "red", "value": 1}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "b"}, "pattern": "solid", "color": "blue", "value": 9}`,
+		}
+
+		batch := []string{
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "c"}, "pattern": "solid", "color": "red", "value": 2}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "b"}, "pattern": "solid", "color": "red", "value": 9}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "d"}, "pattern": "stripe", "color": "red", "value": 7}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "c"}, "pattern": "solid", "color": "red", "value": 8}`,
+			`{"kind": "Ball", "metadata": {"namespace": "test", "name": "e"}, "pattern": "stripe", "color": "blue", "value": 3}`,
+		}
+
+		agenda := func(bulk bool) []string {
+			e, err := registry.NewEngine("", "context-bulk")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer e.Close()
+
+			Expect(e.AddResourceStringList(existing)).To(Succeed())
+
+			if bulk {
+				Expect(e.BulkLoad(batch)).To(Succeed())
+			} else {
+				Expect(e.AddResourceStringList(batch)).To(Succeed())
+			}
+
+			rows, err := e.DB.Query("SELECT ruleNum, resources FROM instantiations ORDER BY ruleNum, resources")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer rows.Close()
+
+			entries := []string{}
+
+			for rows.Next() {
+				var ruleNum int
+				var resources string
+
+				Expect(rows.Scan(&ruleNum, &resources)).To(Succeed())
+				entries = append(entries, fmt.Sprintf("%d:%s", ruleNum, resources))
+			}
+
+			Expect(rows.Err()).ShouldNot(HaveOccurred())
+
+			// The insert triggers are back in place after a bulk load.
+			before := len(entries)
+			Expect(e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "f"}, "pattern": "stripe", "color": "red", "value": 0}`})).To(Succeed())
+
+			var count int
+			Expect(e.DB.QueryRow("SELECT count(*) FROM instantiations").Scan(&count)).To(Succeed())
+			Expect(count).To(Equal(before + 2))
+
+			return entries
+		}
+
+		incremental := agenda(false)
+		Expect(incremental).To(HaveLen(7))
+		Expect(agenda(true)).To(Equal(incremental))
+	})
+
+	It("handles quotes and path syntax in names, values and fields", func() {
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-quoting",
+			Rule(Name("note"),
+				Conditions(
+					Match("Note", "note",
+						Namespace("o'neil"),
+						EQ(Field("metadata", "labels", "app.kubernetes.io/name"), String("it's")),
+						NEQ(Field("text"), String("done 'n' dusted")))),
+				Actions(
+					func(c *RuleContext) error {
+						text, err := c.GetStringField("note", Field("text"), "")
+						if err != nil {
+							return err
+						}
+
+						if err := c.Add(fmt.Sprintf(`{"kind": "Copy", "metadata": {"namespace": "o'neil", "name": "copy'1"}, "text": %q}`, text)); err != nil {
+							return err
+						}
+
+						return c.UpdateField("note", Field("text"), "done 'n' dusted")
+					})))
+
+		e, err := registry.NewEngine("", "context-quoting")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer e.Close()
+
+		Expect(e.AddResourceStringList([]string{
+			`{"kind": "Note", "metadata": {"namespace": "o'neil", "name": "n'1", "labels": {"app.kubernetes.io/name": "it's"}}, "text": "'); DROP TABLE resources; --"}`,
+			`{"kind": "Note", "metadata": {"namespace": "o'neil", "name": "n'2", "labels": {"app.kubernetes.io/name": "its"}}, "text": "skipped"}`,
+		})).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+
+		copied, err := e.GetResource("Copy", "copy'1", "o'neil")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(copied).To(ContainSubstring(`"text": "'); DROP TABLE resources; --"`))
+
+		note, err := e.GetResource("Note", "n'1", "o'neil")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(note).To(ContainSubstring(`"text":"done 'n' dusted"`))
+
+		note, err = e.GetResource("Note", "n'2", "o'neil")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(note).To(ContainSubstring(`"text": "skipped"`))
+	})
+
+	It("escapes backslashes in field labels and rejects double quotes", func() {
+		var quoteErr error
+
+		registry := NewRegistry()
+		registry.RuleSet(
+			"context-labels",
+			Rule(Name("path"),
+				Conditions(Match("Note", "note", EQ(Field("dir", `c:\tmp`), String("yes")))),
+				Actions(
+					func(c *RuleContext) error {
+						quoteErr = c.UpdateField("note", Field(`say "hi"`), "hi")
+						return c.UpdateField("note", Field("dir", `c:\tmp`), "done")
+					})))
+		registry.RuleSet(
+			"context-labels-quoted",
+			Rule(Name("quoted"),
+				Conditions(Match("Note", "note", EQ(Field(`say "hi"`), String("yes")))),
+				Actions(func(c *RuleContext) error { return nil })))
+
+		_, err := registry.NewEngine("", "context-labels-quoted")
+		Expect(errors.Is(err, ErrBadPath)).To(BeTrue())
+
+		e, err := registry.NewEngine("", "context-labels")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer e.Close()
+
+		Expect(e.AddResourceStringList([]string{`{"kind": "Note", "metadata": {"namespace": "test", "name": "n"}, "dir": {"c:\\tmp": "yes"}}`})).To(Succeed())
+		Expect(e.Run()).To(Succeed())
+		Expect(errors.Is(quoteErr, ErrBadPath)).To(BeTrue())
+
+		note, err := e.GetResource("Note", "n", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(note).To(MatchJSON(`{"kind": "Note", "metadata": {"namespace": "test", "name": "n"}, "dir": {"c:\\tmp": "done"}}`))
+	})
+
+	It("updates fields with any JSON value", func() {
+		var badErr error
+
+		RuleSet(
+			"context-update-values",
+			Rule(Name("update"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						badErr = c.UpdateField("ball", Field("bad"), func() {})
+
+						for field, val := range map[string]interface{}{
+							"size":  5,
+							"round": true,
+							"tags":  []string{"a", "b"},
+							"dims":  map[string]float64{"r": 1.5},
+							"color": "blue",
+						} {
+							if err := c.UpdateField("ball", Field(field), val); err != nil {
+								return err
+							}
+						}
+
+						return nil
+					})))
+
+		e, err := newMemoryEngine("context-update-values", "context-update-values")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(errors.Is(badErr, ErrResourceType)).To(BeTrue())
+
+		r, err := e.GetResource("Ball", "foo", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "blue", "size": 5, "round": true, "tags": ["a", "b"], "dims": {"r": 1.5}}`))
+	})
+
+	It("limits, steps and cancels runs", func() {
+		RuleSet(
+			"context-run",
+			Rule(Name("grow"),
+				Conditions(Match("Deployment", "dep", LT(Field("spec", "replicas"), Number(1000000)))),
+				Actions(
+					func(c *RuleContext) error {
+						replicas, err := c.GetIntField("dep", Field("spec", "replicas"), 0)
+						if err != nil {
+							return err
+						}
+
+						return c.UpdateField("dep", Field("spec", "replicas"), replicas+1)
+					})))
+
+		e, err := newMemoryEngine("context-run", "context-run")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 0}}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		fired, err := e.RunN(3)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fired).To(Equal(3))
+
+		firing, err := e.Step()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(firing.Rule).To(Equal("grow"))
+		Expect(firing.Resources).To(HaveLen(1))
+
+		r, err := e.GetResource("Deployment", "dep", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 4}}`))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(e.RunContext(ctx, RunOptions{})).To(MatchError(context.Canceled))
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(e.RunContext(ctx, RunOptions{})).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("counts failed actions against the RunN limit", func() {
+		calls := 0
+
+		RuleSet(
+			"context-run-failing",
+			Rule(Name("fail"),
+				OnError(ErrorPolicy{MaxAttempts: 100}),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						calls++
+						return errors.New("always fails")
+					})))
+
+		e, err := newMemoryEngine("context-run-failing", "context-run-failing")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		fired, err := e.RunN(3)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fired).To(Equal(0))
+		Expect(calls).To(Equal(3))
+	})
+
+	It("keeps working after a run or dry run is cancelled mid-transaction", func() {
+		RuleSet(
+			"context-cancel",
+			Rule(Name("grow"),
+				Conditions(Match("Deployment", "dep", LT(Field("spec", "replicas"), Number(1000000000)))),
+				Actions(
+					func(c *RuleContext) error {
+						replicas, err := c.GetIntField("dep", Field("spec", "replicas"), 0)
+						if err != nil {
+							return err
+						}
+
+						return c.UpdateField("dep", Field("spec", "replicas"), replicas+1)
+					})))
+
+		// The engine's own in-memory database is the one at risk.
+		e, err := NewEngine("", "context-cancel")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer e.Close()
+		err = e.AddResourceStringList([]string{`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 0}}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(e.RunContext(ctx, RunOptions{})).To(MatchError(context.DeadlineExceeded))
+
+		fired, err := e.RunN(5)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fired).To(Equal(5))
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = e.DryRun(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		fired, err = e.RunN(5)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(fired).To(Equal(5))
+	})
+
+	It("fires rules as resources stream in while serving", func() {
+		RuleSet(
+			"context-serve",
+			Rule(Name("copy"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						return c.AddLogical(fmt.Sprintf(`{"kind": "Copy", "metadata": {"namespace": "test", "name": "%s"}}`, name))
+					})))
+
+		e, err := newMemoryEngine("context-serve", "context-serve")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+
+		go func() {
+			done <- e.Serve(ctx)
+		}()
+
+		for _, name := range []string{"foo", "bar"} {
+			err = e.AddResourceStringList([]string{fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "%s"}, "color": "red"}`, name)})
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(func() error { return e.WaitIdle(context.Background()) }).Should(Succeed())
+			Expect(e.Busy()).To(BeFalse())
+
+			_, err = e.GetResource("Copy", name, "test")
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+
+		Expect(e.DeleteResource("Ball", "foo", "test")).To(Succeed())
+		Expect(e.WaitIdle(context.Background())).To(Succeed())
+
+		_, err = e.GetResource("Copy", "foo", "test")
+		Expect(err).To(Equal(sql.ErrNoRows))
+
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+
+		// With Serve stopped, waiting on pending work fails instead of hanging.
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "baz"}, "color": "red"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.WaitIdle(context.Background())).To(MatchError(ErrNotServing))
+	})
+
+	It("keeps serving after a rule reaches its firing limit", func() {
+		RuleSet(
+			"context-serve-limit",
+			Rule(Name("loop"), MaxFirings(3),
+				Conditions(Match("Deployment", "dep", LT(Field("spec", "replicas"), Number(1000)))),
+				Actions(
+					func(c *RuleContext) error {
+						replicas, err := c.GetIntField("dep", Field("spec", "replicas"), 0)
+						if err != nil {
+							return err
+						}
+
+						return c.UpdateField("dep", Field("spec", "replicas"), replicas+1)
+					})))
+
+		e, err := newMemoryEngine("context-serve-limit", "context-serve-limit")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+
+		go func() {
+			done <- e.Serve(ctx)
+		}()
+
+		for _, name := range []string{"foo", "bar"} {
+			err = e.AddResourceStringList([]string{fmt.Sprintf(`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "%s"}, "spec": {"replicas": 0}}`, name)})
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(func() error { return e.WaitIdle(context.Background()) }).Should(Succeed())
+
+			r, err := e.GetResource("Deployment", name, "test")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(r).To(MatchJSON(fmt.Sprintf(`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "%s"}, "spec": {"replicas": 3}}`, name)))
+		}
+
+		letters, err := e.DeadLetters()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(letters).To(HaveLen(2))
+		Consistently(done).ShouldNot(Receive())
+
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+	})
+
+	It("fires independent instantiations concurrently and retries conflicts", func() {
+		var lock sync.Mutex
+		var running, maxRunning int
+		copies := map[string]int{}
+
+		// The first action waits for a second one to start alongside it.
+		together := make(chan struct{})
+
+		RuleSet(
+			"context-parallel",
+			Rule(Name("count"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						lock.Lock()
+						running++
+						if running > maxRunning {
+							maxRunning = running
+						}
+						if running == 2 {
+							close(together)
+						}
+						lock.Unlock()
+
+						<-together
+
+						lock.Lock()
+						running--
+						lock.Unlock()
+
+						counter, err := c.Get("Counter", "counter", "test")
+						if err != nil {
+							return err
+						}
+
+						count, err := counter.Get(Field("count"))
+						if err != nil {
+							return err
+						}
+
+						if err := c.Set(counter, Field("count"), count.(float64)+1); err != nil {
+							return err
+						}
+
+						return c.Add(counter)
+					})),
+			Rule(Name("copy"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("blue")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						lock.Lock()
+						copies[name]++
+						lock.Unlock()
+
+						return c.Add(fmt.Sprintf(`{"kind": "Copy", "metadata": {"namespace": "test", "name": "%s"}}`, name))
+					})))
+
+		e, err := newMemoryEngine("context-parallel", "context-parallel")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		resources := []string{`{"kind": "Counter", "metadata": {"namespace": "test", "name": "counter"}, "count": 0}`}
+		for i := 0; i < 8; i++ {
+			resources = append(resources,
+				fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "ball-%d"}, "color": "red"}`, i),
+				fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "blue-%d"}, "color": "blue"}`, i))
+		}
+
+		Expect(e.AddResourceStringList(resources)).To(Succeed())
+		Expect(e.RunParallel(context.Background(), 4)).To(Succeed())
+		Expect(maxRunning).To(BeNumerically(">", 1))
+
+		r, err := e.GetResource("Counter", "counter", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Counter", "metadata": {"namespace": "test", "name": "counter"}, "count": 8}`))
+
+		// Firings that did not conflict are never run again.
+		Expect(copies).To(HaveLen(8))
+		for name, n := range copies {
+			Expect(n).To(Equal(1), name)
+		}
+	})
+
+	It("commits batches of independent firings", func() {
+		RuleSet(
+			"context-parallel-copy",
+			Rule(Name("copy"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						name, err := c.GetStringField("ball", Field("metadata", "name"), "")
+						if err != nil {
+							return err
+						}
+
+						return c.Add(fmt.Sprintf(`{"kind": "Copy", "metadata": {"namespace": "test", "name": "%s"}}`, name))
+					})))
+
+		e, err := newMemoryEngine("context-parallel-copy", "context-parallel-copy")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		resources := []string{}
+		for i := 0; i < 9; i++ {
+			resources = append(resources, fmt.Sprintf(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "ball-%d"}, "color": "red"}`, i))
+		}
+
+		Expect(e.AddResourceStringList(resources)).To(Succeed())
+		Expect(e.RunParallel(context.Background(), 4)).To(Succeed())
+
+		var count int
+		Expect(e.DB.QueryRow("SELECT count(*) FROM resources WHERE KIND = 'Copy'").Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(9))
+		Expect(e.DB.QueryRow("SELECT count(*) FROM instantiations").Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(0))
+	})
+
+	DescribeTable("guards against rules re-activating themselves", func(name string, guard RuleArg, replicas int, errText string) {
+		RuleSet(
+			name,
+			Rule(Name(name), guard,
+				Conditions(Match("Deployment", "dep", LT(Field("spec", "replicas"), Number(1000)))),
+				Actions(
+					func(c *RuleContext) error {
+						replicas, err := c.GetIntField("dep", Field("spec", "replicas"), 0)
+						if err != nil {
+							return err
+						}
+
+						return c.UpdateField("dep", Field("spec", "replicas"), replicas+1)
+					})))
+
+		e, err := newMemoryEngine(name, name)
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 0}}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		if errText == "" {
+			Expect(e.Run()).To(Succeed())
+		} else {
+			for i := 0; i < replicas; i++ {
+				_, err := e.Step()
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			firing, err := e.Step()
+			Expect(err).To(MatchError(errText))
+			Expect(firing.Resources).To(Equal([]int{1}))
+
+			var limitErr *FiringLimitError
+			Expect(errors.As(err, &limitErr)).To(BeTrue())
+			Expect(limitErr.Resources).To(Equal([]int{1}))
+
+			// The runaway instantiation was dead-lettered, so the engine is
+			// not stuck on it.
+			letters, err := e.DeadLetters()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(letters).To(HaveLen(1))
+			Expect(letters[0].Error).To(Equal(errText))
+			Expect(e.Run()).To(Succeed())
+		}
+
+		r, err := e.GetResource("Deployment", "dep", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(fmt.Sprintf(`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": %d}}`, replicas)))
+
+		if errText == "" {
+			err = e.AddResourceStringList([]string{`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 10}}`})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(e.Run()).To(Succeed())
+
+			r, err = e.GetResource("Deployment", "dep", "test")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(r).To(MatchJSON(`{"kind": "Deployment", "metadata": {"namespace": "test", "name": "dep"}, "spec": {"replicas": 11}}`))
+		}
+	},
+		Entry("no-loop", "context-no-loop", NoLoop(), 1, ""),
+		Entry("lock-on-active", "context-lock-on-active", LockOnActive(), 1, ""),
+		Entry("max firings", "context-max-firings", MaxFirings(5), 5, "rule context-max-firings exceeded 5 firings for resources [1]"))
+
+	It("re-matches only when referenced fields change", func() {
+		fired := 0
+
+		RuleSet(
+			"context-reactive",
+			Rule(Name("red"),
+				Conditions(Match("Ball", "ball", EQ(Field("color"), String("red")))),
+				Actions(
+					func(c *RuleContext) error {
+						fired++
+						return c.AddLogical(`{"kind": "Derived", "metadata": {"namespace": "test", "name": "derived"}}`)
+					})))
+
+		e, err := newMemoryEngine("context-reactive", "context-reactive")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "status": "new"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var before, after int
+		Expect(e.DB.QueryRow("SELECT ID FROM instantiations").Scan(&before)).To(Succeed())
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "status": "seen"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.DB.QueryRow("SELECT ID FROM instantiations").Scan(&after)).To(Succeed())
+		Expect(after).To(Equal(before))
+
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(1))
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "status": "done"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(1))
+
+		// The derived fact survives updates its match does not depend on.
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "blue", "status": "done"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).To(MatchError(sql.ErrNoRows))
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo"}, "color": "red", "status": "done"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(2))
+	})
+
+	It("skips upserts that do not change a resource", func() {
+		fired := 0
+
+		RuleSet(
+			"context-no-op",
+			Rule(Name("derive"),
+				Conditions(Match("Ball", "ball", EQ(Field("metadata", "resourceVersion"), Field("metadata", "resourceVersion")))),
+				Actions(
+					func(c *RuleContext) error {
+						fired++
+						return c.AddLogical(`{"kind": "Derived", "metadata": {"namespace": "test", "name": "derived"}}`)
+					})))
+
+		e, err := newMemoryEngine("context-no-op", "context-no-op")
+		Expect(err).ShouldNot(HaveOccurred())
+		e.IgnoreChanges("metadata.resourceVersion")
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo", "resourceVersion": "1"}, "color": "red", "size": 10}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(1))
+
+		err = e.AddResourceStringList([]string{`{"size": 10, "color": "red", "metadata": {"resourceVersion": "2", "name": "foo", "namespace": "test"}, "kind": "Ball"}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(1))
+
+		// The stored data is brought up to date without re-matching.
+		r, err := e.GetResource("Ball", "foo", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r).To(MatchJSON(`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo", "resourceVersion": "2"}, "color": "red", "size": 10}`))
+
+		_, err = e.GetResource("Derived", "derived", "test")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		err = e.AddResourceStringList([]string{`{"kind": "Ball", "metadata": {"namespace": "test", "name": "foo", "resourceVersion": "3"}, "color": "red", "size": 11}`})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Run()).To(Succeed())
+		Expect(fired).To(Equal(2))
 	})
 })
 
@@ -392,16 +2429,16 @@ INSERT INTO instantiations (ruleNum, resources) VALUES (0, json_array(1, 4))
 `
 
 func NewTestEngine() (*Engine, error) {
-	db, err := getTestDB()
+	db, anchor, err := getTestDB()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Engine{DB: db, KeyFunction: defaultKeyFunc}, nil
+	return &Engine{DB: db, anchor: anchor, KeyFunction: defaultKeyFunc}, nil
 }
 
-func getTestDB() (*sql.DB, error) {
-	db, err := getDB()
+func getTestDB() (*sql.DB, *sql.Conn, error) {
+	db, anchor, err := getDB("")
 	Expect(err).To(BeNil())
 
 	entries := strings.Split(testData, "\n")
@@ -415,16 +2452,16 @@ func getTestDB() (*sql.DB, error) {
 		s, err := db.Prepare(entry)
 		fmt.Printf("ENTRY: %s\n", entry)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		_, err = s.Exec()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return db, nil
+	return db, anchor, nil
 }
 
 type riEntry struct {
@@ -459,3 +2496,25 @@ func getResourceInstantiationConnections(db *sql.DB) ([]riEntry, error) {
 
 	return entries, nil
 }
+
+func newMemoryEngine(name string, rulesets ...string) (*Engine, error) {
+	return NewEngine(fmt.Sprintf("file:%s?mode=memory&cache=shared", name), rulesets...)
+}
+
+// legacySchema is the layout databases had before the schema was versioned.
+const legacySchema = `
+CREATE TABLE instantiations (ID INTEGER PRIMARY KEY, ruleNum INTEGER NOT NULL, priority INTEGER NOT NULL DEFAULT 0, timestamp INTEGER, active BOOL NOT NULL DEFAULT true, resources JSON NOT NULL)
+CREATE TRIGGER instantiation_expansion_TRIGGER AFTER INSERT ON instantiations BEGIN UPDATE instantiations SET timestamp = time('now', 'unixepoch') WHERE ID = NEW.ID; END
+CREATE TRIGGER instantiation_connection_TRIGGER AFTER INSERT ON instantiations BEGIN INSERT INTO resource_instantiations SELECT value, NEW.ID FROM json_each(NEW.resources); END
+CREATE TRIGGER instantiation_delete_TRIGGER AFTER DELETE ON instantiations BEGIN DELETE FROM resource_instantiations WHERE instantiation_ID = OLD.ID; END
+CREATE INDEX instantiation_priority_INDEX ON instantiations (priority, timestamp, active)
+CREATE TABLE resource_instantiations (resource_ID INTEGER NOT NULL, instantiation_ID INTEGER NOT NULL)
+CREATE INDEX resource_instantiations_INDEX ON resource_instantiations (resource_ID)
+CREATE INDEX instantiation_resources_INDEX ON resource_instantiations (instantiation_ID, resource_ID)
+CREATE TABLE resources (ID INTEGER PRIMARY KEY, KIND TEXT NOT NULL, NAME TEXT NOT NULL DEFAULT "", NAMESPACE TEXT NOT NULL DEFAULT "", DATA JSON NOT NULL)
+CREATE UNIQUE INDEX unique_resource_INDEX ON resources (KIND, NAME, NAMESPACE)
+CREATE INDEX namespace_resource_INDEX ON resources (NAMESPACE)
+CREATE TRIGGER resource_upsert_TRIGGER BEFORE UPDATE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = NEW.ID); DELETE FROM resource_instantiations WHERE resource_ID = NEW.ID; END
+CREATE TRIGGER resource_delete_TRIGGER AFTER DELETE ON resources BEGIN DELETE FROM instantiations WHERE ID IN (SELECT instantiation_ID FROM resource_instantiations WHERE resource_ID = OLD.ID); DELETE FROM resource_instantiations WHERE resource_ID = OLD.ID; END
+CREATE TABLE configuration (name TEXT PRIMARY KEY, val)
+`
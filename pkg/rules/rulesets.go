@@ -0,0 +1,330 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+type compiledRule struct {
+	index      int
+	rule       *RuleVal
+	objectMap  map[string]int
+	triggers   []string
+	triggerSQL map[string]string
+	indexes    map[string]string
+	create     []string
+	match      string
+	identity   string
+}
+
+type compiledRuleSet struct {
+	ruleSet *RuleSetVal
+	rules   []*compiledRule
+}
+
+// compileRuleSet compiles a rule set for installation after the rules
+// already installed, other than those of the replaced rule set, if any.
+func (e *Engine) compileRuleSet(rs *RuleSetVal, replaced *RuleSetVal) (*compiledRuleSet, error) {
+	// Each installation gets its own RuleSetVal so that a rule set added
+	// twice can be told apart when one copy is removed.
+	compiled := &compiledRuleSet{ruleSet: &RuleSetVal{Name: rs.Name, Rules: rs.Rules}}
+	ruleID := e.RuleCount
+	occurrence := 0
+
+	for _, installed := range e.RuleSets {
+		if installed.Name == rs.Name && installed != replaced {
+			occurrence++
+		}
+	}
+
+	for position, rule := range rs.Rules {
+		idata := &InstantiationData{
+			Names:     []string{},
+			RuleIndex: ruleID,
+			Tables:    map[string]string{},
+			Refs:      map[string]bool{},
+			Queries:   map[string]Queries{},
+			Indexes:   map[string]map[string]bool{},
+		}
+
+		match, err := rule.Instantiate(idata, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		cr := &compiledRule{index: ruleID, rule: rule, objectMap: idata.ObjectMap, triggerSQL: map[string]string{}, indexes: map[string]string{}, match: match}
+
+		group := rule.Group
+		if group == "" {
+			group = rs.Name
+		}
+
+		if cr.identity, err = ruleIdentity(rule, group, position, occurrence); err != nil {
+			return nil, err
+		}
+
+		for key, val := range idata.Queries {
+			if key == "" {
+				continue
+			}
+
+			cr.create = val.AddSQL(cr.create)
+
+			for suffix, query := range map[string]string{"i": val.Insert, "u": val.Update, "d": val.Delete} {
+				if query != "" {
+					name := fmt.Sprintf("%s_resources_%s_%d", key, suffix, ruleID)
+					cr.triggers = append(cr.triggers, name)
+					cr.triggerSQL[name] = query
+				}
+			}
+		}
+
+		for kind, idxs := range idata.Indexes {
+			for p := range idxs {
+				name := unsafeName.ReplaceAllString(fmt.Sprintf("%s_%s", kind, strings.TrimPrefix(p, "$.")), "_")
+				cr.indexes[name] = fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON resources (json_extract(DATA, %s)) WHERE KIND = %s", name, quoteSQL(p), quoteSQL(kind))
+			}
+		}
+
+		compiled.rules = append(compiled.rules, cr)
+		ruleID++
+	}
+
+	return compiled, nil
+}
+
+func (e *Engine) installedRuleSet(name string) *RuleSetVal {
+	for _, rs := range e.RuleSets {
+		if rs.Name == name {
+			return rs
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) RemoveRuleSet(name string) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	removed := e.installedRuleSet(name)
+	if removed == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchRuleSet, name)
+	}
+
+	if err := e.swapRuleSets(removed, nil); err != nil {
+		return err
+	}
+
+	e.notify()
+
+	return nil
+}
+
+// ReplaceRuleSet swaps the rules of an installed rule set for new ones in a
+// single transaction. Pending instantiations and logical resources of the
+// old rules are dropped, and the new rules are matched against the
+// resources already in working memory.
+func (e *Engine) ReplaceRuleSet(name string, rules ...*RuleVal) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	removed := e.installedRuleSet(name)
+	if removed == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchRuleSet, name)
+	}
+
+	compiled, err := e.compileRuleSet(&RuleSetVal{Name: name, Rules: rules}, removed)
+	if err != nil {
+		return err
+	}
+
+	if err := e.swapRuleSets(removed, compiled); err != nil {
+		return err
+	}
+
+	e.notify()
+
+	return nil
+}
+
+// swapRuleSets uninstalls the removed rule set and installs the added one,
+// either of which may be nil, in one transaction. The caller holds txLock.
+func (e *Engine) swapRuleSets(removedSet *RuleSetVal, added *compiledRuleSet) error {
+	removed := []int{}
+
+	if removedSet != nil {
+		for i := range removedSet.Rules {
+			removed = append(removed, e.ruleSetFirst[removedSet]+i)
+		}
+	}
+
+	refs := map[string]int{}
+	stmts := []string{}
+
+	for _, idx := range removed {
+		for _, trigger := range e.ruleTriggers[idx] {
+			stmts = append(stmts, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", trigger))
+		}
+
+		stmts = append(stmts, fmt.Sprintf("DROP TRIGGER IF EXISTS %s", disabledTrigger(idx)))
+
+		stmts = append(stmts,
+			fmt.Sprintf("DELETE FROM instantiations WHERE ruleNum = %d", idx),
+			fmt.Sprintf("DELETE FROM justifications WHERE ruleNum = %d", idx),
+			fmt.Sprintf("DELETE FROM rules WHERE ruleNum = %d", idx))
+
+		for _, name := range e.ruleIndexes[idx] {
+			refs[name]--
+		}
+	}
+
+	creates := map[string]string{}
+	resumed := map[int]bool{}
+
+	if added != nil {
+		for _, cr := range added.rules {
+			adopted := e.adoptTriggers(cr)
+			if !adopted {
+				stmts = append(stmts, e.staleTriggerDrops(cr.index)...)
+				stmts = append(stmts, cr.create...)
+			}
+
+			stmts = append(stmts, fmt.Sprintf("INSERT INTO rules (ruleNum, identity, after, deadline_path, deadline_index) VALUES (%d, %s, %s) ON CONFLICT (ruleNum) DO UPDATE SET identity = excluded.identity, after = excluded.after, deadline_path = excluded.deadline_path, deadline_index = excluded.deadline_index", cr.index, quoteSQL(cr.identity), timerValues(cr)))
+
+			if resume := e.resumeStatements(cr, adopted); resume != nil {
+				stmts = append(stmts, resume...)
+				resumed[cr.index] = true
+			}
+
+			for name, create := range cr.indexes {
+				refs[name]++
+				creates[name] = create
+			}
+		}
+	}
+
+	for name, delta := range refs {
+		before := e.indexRefs[name]
+
+		switch {
+		case before > 0 && before+delta == 0:
+			stmts = append(stmts, fmt.Sprintf("DROP INDEX IF EXISTS %s", name))
+		case before == 0 && delta > 0:
+			stmts = append(stmts, creates[name])
+		}
+	}
+
+	// Match the new rules against the resources already present, parking
+	// the instantiations of rules that were disabled before.
+	if added != nil {
+		for _, cr := range added.rules {
+			disabled, err := e.ruleDisabled(cr.rule.Name)
+			if err != nil {
+				return err
+			}
+
+			if disabled {
+				stmts = append(stmts, disableSQL(cr.index))
+			}
+
+			// Instantiations of resumed rules are already on the agenda.
+			if !resumed[cr.index] {
+				stmts = append(stmts, cr.match)
+			}
+		}
+	}
+
+	if err := e.ApplyInTransaction(stmts); err != nil {
+		return err
+	}
+
+	for name, delta := range refs {
+		if e.indexRefs[name] += delta; e.indexRefs[name] == 0 {
+			delete(e.indexRefs, name)
+		}
+	}
+
+	if removedSet != nil {
+		e.forgetRuleSet(removedSet, removed)
+	}
+
+	if added != nil {
+		e.RuleSets = append(e.RuleSets, added.ruleSet)
+		e.ruleSetFirst[added.ruleSet] = e.RuleCount
+
+		for _, cr := range added.rules {
+			group := cr.rule.Group
+			if group == "" {
+				group = added.ruleSet.Name
+			}
+
+			e.RuleNameToIndex[cr.rule.Name] = cr.index
+			e.IndexToRuleName[cr.index] = cr.rule.Name
+			e.RuleFunctions[cr.index] = cr.rule.Actions
+			e.ObjectMaps[cr.index] = cr.objectMap
+			e.GroupRules[group] = append(e.GroupRules[group], cr.index)
+			e.IndexToGroup[cr.index] = group
+			e.Rules[cr.index] = cr.rule
+			e.ruleTriggers[cr.index] = cr.triggers
+			e.ruleMatches[cr.index] = cr.match
+			e.ruleIdentities[cr.index] = cr.identity
+
+			for name := range cr.indexes {
+				e.ruleIndexes[cr.index] = append(e.ruleIndexes[cr.index], name)
+			}
+		}
+
+		e.RuleCount += len(added.rules)
+	}
+
+	return nil
+}
+
+func (e *Engine) forgetRuleSet(removedSet *RuleSetVal, removed []int) {
+	ruleSets := []*RuleSetVal{}
+
+	for _, rs := range e.RuleSets {
+		if rs != removedSet {
+			ruleSets = append(ruleSets, rs)
+		}
+	}
+
+	e.RuleSets = ruleSets
+	delete(e.ruleSetFirst, removedSet)
+
+	for _, idx := range removed {
+		if name := e.IndexToRuleName[idx]; e.RuleNameToIndex[name] == idx {
+			delete(e.RuleNameToIndex, name)
+		}
+
+		group := e.IndexToGroup[idx]
+		kept := []int{}
+
+		for _, num := range e.GroupRules[group] {
+			if num != idx {
+				kept = append(kept, num)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(e.GroupRules, group)
+		} else {
+			e.GroupRules[group] = kept
+		}
+
+		delete(e.IndexToRuleName, idx)
+		delete(e.RuleFunctions, idx)
+		delete(e.ObjectMaps, idx)
+		delete(e.IndexToGroup, idx)
+		delete(e.Rules, idx)
+		delete(e.ruleTriggers, idx)
+		delete(e.ruleMatches, idx)
+		delete(e.ruleIdentities, idx)
+		delete(e.ruleIndexes, idx)
+	}
+}
@@ -0,0 +1,120 @@
+package rules
+
+import (
+	"context"
+	"time"
+)
+
+// notify records that working memory changed and wakes Serve if it is
+// waiting.
+func (e *Engine) notify() {
+	e.serveLock.Lock()
+	e.notified++
+
+	if e.idle == nil {
+		e.idle = make(chan struct{})
+	}
+	e.serveLock.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Serve fires rules as resources are added or deleted until the context is
+// done or an action calls Halt.
+func (e *Engine) Serve(ctx context.Context) error {
+	stopped := make(chan struct{})
+
+	e.serveLock.Lock()
+	e.serving = stopped
+	e.serveLock.Unlock()
+
+	defer func() {
+		e.serveLock.Lock()
+		if e.serving == stopped {
+			e.serving = nil
+		}
+		e.serveLock.Unlock()
+
+		close(stopped)
+	}()
+
+	for {
+		e.serveLock.Lock()
+		seen := e.notified
+		e.serveLock.Unlock()
+
+		_, halted, err := e.run(ctx, RunOptions{})
+		if err != nil {
+			return err
+		}
+
+		if halted {
+			return nil
+		}
+
+		e.serveLock.Lock()
+		if e.notified == seen && e.idle != nil {
+			close(e.idle)
+			e.idle = nil
+		}
+		e.serveLock.Unlock()
+
+		// Parked instantiations and expiring resources wake the loop.
+		var retry <-chan time.Time
+		stop := func() bool { return false }
+
+		at, ok, err := e.nextWakeup(ctx)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			retry, stop = e.timer(at.Sub(e.now()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.wake:
+		case <-retry:
+		}
+
+		stop()
+	}
+}
+
+func (e *Engine) Busy() bool {
+	e.serveLock.Lock()
+	defer e.serveLock.Unlock()
+
+	return e.idle != nil
+}
+
+// WaitIdle blocks until Serve has fired everything enqueued by earlier
+// changes to working memory. It returns ErrNotServing if Serve is not
+// running, or stops before the engine is idle, while there is work pending.
+func (e *Engine) WaitIdle(ctx context.Context) error {
+	e.serveLock.Lock()
+	idle, serving := e.idle, e.serving
+	e.serveLock.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+
+	if serving == nil {
+		return ErrNotServing
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-idle:
+		return nil
+	case <-serving:
+		return ErrNotServing
+	}
+}
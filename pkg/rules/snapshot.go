@@ -0,0 +1,270 @@
+package rules
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Tables saved by Snapshot, in the order Restore loads them. The link
+// tables are rebuilt by triggers as instantiations and justifications are
+// inserted.
+var snapshotTables = []string{"resources", "instantiations", "justifications", "configuration", "outbox", "dead_letters"}
+
+var snapshotColumn = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Snapshots from before version 3 do not record rule identities, so their
+// instantiations cannot be matched to rules.
+const minSnapshotVersion = 3
+
+type snapshotHeader struct {
+	Version int `json:"version"`
+}
+
+type snapshotRow struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+// Snapshot writes working memory, the agenda and engine configuration to w
+// as newline-delimited JSON: a header line followed by one line per row.
+func (e *Engine) Snapshot(w io.Writer) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	tx, err := e.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(snapshotHeader{Version: schemaVersion}); err != nil {
+		return err
+	}
+
+	for _, table := range snapshotTables {
+		rows, err := tx.Query(fmt.Sprintf("SELECT * FROM %s ORDER BY rowid", table))
+		if err != nil {
+			return err
+		}
+
+		cols, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		for rows.Next() {
+			vals := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return err
+			}
+
+			row := map[string]interface{}{}
+
+			for i, col := range cols {
+				if b, ok := vals[i].([]byte); ok {
+					vals[i] = string(b)
+				}
+
+				row[col] = vals[i]
+			}
+
+			if err := enc.Encode(snapshotRow{Table: table, Row: row}); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore replaces working memory, the agenda and engine configuration with
+// the contents of a snapshot. Pending instantiations are matched to this
+// engine's rules by rule identity; those of rules it does not have are
+// dropped.
+func (e *Engine) Restore(r io.Reader) (err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+
+	var header snapshotHeader
+
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+
+	if header.Version > schemaVersion || header.Version < minSnapshotVersion {
+		return fmt.Errorf("%w: snapshot is at version %d, engine restores %d to %d", ErrSchemaVersion, header.Version, minSnapshotVersion, schemaVersion)
+	}
+
+	tx, err := e.beginTx(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+
+	for i := len(snapshotTables) - 1; i >= 0; i-- {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", snapshotTables[i])); err != nil {
+			return err
+		}
+	}
+
+	// Restoring resources fires the rule triggers; the snapshot's own
+	// instantiations replace the ones they create.
+	matched := false
+
+	for {
+		var sr snapshotRow
+
+		err := dec.Decode(&sr)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if sr.Table == "configuration" && sr.Row["name"] == "schema_version" {
+			continue
+		}
+
+		if sr.Table != "resources" && !matched {
+			if _, err := tx.Exec("DELETE FROM instantiations"); err != nil {
+				return err
+			}
+
+			matched = true
+		}
+
+		if err := insertSnapshotRow(tx, sr); err != nil {
+			return err
+		}
+	}
+
+	if !matched {
+		if _, err := tx.Exec("DELETE FROM instantiations"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO configuration (name, val) VALUES ('schema_version', %d)", schemaVersion)); err != nil {
+		return err
+	}
+
+	// Snapshots from before version 8 do not record which resources were
+	// stated; the justified ones were logical.
+	if header.Version < 8 {
+		if _, err := tx.Exec("UPDATE resources SET STATED = false WHERE ID IN (SELECT resource_ID FROM justifications)"); err != nil {
+			return err
+		}
+	}
+
+	// Hand the restored instantiations to this engine's rules by identity.
+	for _, table := range []string{"instantiations", "justifications"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rule_id IS NULL OR rule_id NOT IN (SELECT identity FROM rules)", table)); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET ruleNum = (SELECT ruleNum FROM rules WHERE identity = rule_id)", table)); err != nil {
+			return err
+		}
+	}
+
+	// Bring the disabled rule triggers in line with the restored settings.
+	for num, rule := range e.Rules {
+		var disabled bool
+
+		err := tx.QueryRow("SELECT val FROM configuration WHERE name = ?", disabledKey(rule.Name)).Scan(&disabled)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		stmt := fmt.Sprintf("DROP TRIGGER IF EXISTS %s", disabledTrigger(num))
+		if disabled {
+			stmt = disableSQL(num)
+		}
+
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	e.notify()
+
+	return nil
+}
+
+func insertSnapshotRow(tx *sql.Tx, sr snapshotRow) error {
+	known := false
+
+	for _, table := range snapshotTables {
+		known = known || table == sr.Table
+	}
+
+	if !known {
+		return fmt.Errorf("%w: unknown table %s", ErrSnapshotFormat, sr.Table)
+	}
+
+	cols := []string{}
+	marks := []string{}
+	args := []interface{}{}
+
+	for col, val := range sr.Row {
+		if !snapshotColumn.MatchString(col) {
+			return fmt.Errorf("%w: bad column %s", ErrSnapshotFormat, col)
+		}
+
+		// Numbers come back as json.Number so that nanosecond times keep
+		// their precision.
+		if n, ok := val.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				val = i
+			} else if f, err := n.Float64(); err == nil {
+				val = f
+			}
+		}
+
+		cols = append(cols, col)
+		marks = append(marks, "?")
+		args = append(args, val)
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", sr.Table, strings.Join(cols, ", "), strings.Join(marks, ", ")), args...)
+
+	return err
+}
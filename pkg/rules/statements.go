@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Statements run on every firing. Each engine prepares them once, before
+// any transaction is open, and rebinds them into each firing's transaction.
+var cachedStatements = []string{
+	agendaSQL,
+	focusedAgendaSQL,
+	deleteInstantiationSQL,
+	insertSQL + " RETURNING ID",
+	logicalInsertSQL + " RETURNING ID",
+	statedSQL,
+	deleteResourceSQL,
+	getFieldSQL,
+	setFieldSQL,
+	justifySQL,
+	clockSQL,
+}
+
+func (e *Engine) prepareStatements() error {
+	e.stmtLock.Lock()
+	defer e.stmtLock.Unlock()
+
+	for _, query := range cachedStatements {
+		stmt, err := e.DB.Prepare(query)
+		if err != nil {
+			return err
+		}
+
+		e.statements[query] = stmt
+	}
+
+	return nil
+}
+
+// prepared returns the statement for query bound to tx, preparing it in tx
+// if it is not cached.
+func (e *Engine) prepared(ctx context.Context, tx *sql.Tx, query string) (*sql.Stmt, error) {
+	e.stmtLock.Lock()
+	stmt, ok := e.statements[query]
+	e.stmtLock.Unlock()
+
+	if !ok {
+		return tx.PrepareContext(ctx, query)
+	}
+
+	return tx.StmtContext(ctx, stmt), nil
+}
+
+func (e *Engine) closeStatements() error {
+	e.stmtLock.Lock()
+	defer e.stmtLock.Unlock()
+
+	var firstErr error
+
+	for query, stmt := range e.statements {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delete(e.statements, query)
+	}
+
+	return firstErr
+}
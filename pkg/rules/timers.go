@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type DeadlineVal struct {
+	Name  string
+	Field FieldVal
+}
+
+// After delays a rule until its match has held for d. The wait restarts
+// whenever the match is broken and re-made.
+func After(d time.Duration) RuleArg {
+	return func(rv *RuleVal) {
+		rv.After = d
+	}
+}
+
+// Every fires a rule again each interval for as long as its match holds.
+func Every(interval time.Duration) RuleArg {
+	return func(rv *RuleVal) {
+		rv.Every = interval
+	}
+}
+
+// Deadline delays a rule until the RFC 3339 time held in a field of one of
+// its matched resources. A match without the field never fires.
+func Deadline(name string, f FieldVal) RuleArg {
+	return func(rv *RuleVal) {
+		rv.Deadline = &DeadlineVal{Name: name, Field: f}
+	}
+}
+
+const clockSQL = "UPDATE clock SET now = ?"
+
+// The instantiation timer trigger stamps each new instantiation of an After
+// or Deadline rule with the time it becomes ready to fire, reading the
+// rule's timer from the rules table and the current time from the clock
+// table. beginTx sets that clock to the engine's time, so every transaction
+// that can change working memory should be started with it.
+//
+// The transaction itself is not bound to ctx: database/sql rolls back a
+// cancelled transaction in the background and discards its connection,
+// racing the next transaction for the database lock. Cancellation instead
+// interrupts the statement in progress and the caller rolls back.
+func (e *Engine) beginTx(ctx context.Context) (*sql.Tx, error) {
+	tx, err := e.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := e.prepared(ctx, tx, clockSQL)
+	if err == nil {
+		_, err = stmt.ExecContext(ctx, e.now().UnixNano())
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// timerValues returns the after, deadline_path and deadline_index values of
+// a rule's row in the rules table.
+func timerValues(cr *compiledRule) string {
+	if deadline := cr.rule.Deadline; deadline != nil {
+		// The path was checked when the rule was compiled.
+		path, _ := jsonPath(deadline.Field.Path)
+
+		return fmt.Sprintf("0, %s, %d", quoteSQL(path), cr.objectMap[deadline.Name])
+	}
+
+	return fmt.Sprintf("%d, NULL, NULL", int64(cr.rule.After))
+}
+
+// reschedule puts the instantiation of an Every rule back on the agenda,
+// due one interval from now, if its resources still match the rule after
+// the firing.
+func (e *Engine) reschedule(ctx context.Context, tx *sql.Tx, firing *Firing) error {
+	rule := e.Rules[firing.RuleIndex]
+	if rule == nil || rule.Every <= 0 {
+		return nil
+	}
+
+	resources, err := json.Marshal(firing.Resources)
+	if err != nil {
+		return err
+	}
+
+	// Drop any instantiation the action itself caused so it is not doubled.
+	_, err = tx.ExecContext(ctx, "DELETE FROM instantiations WHERE ruleNum = ? AND json(resources) = json(?)", firing.RuleIndex, string(resources))
+	if err != nil {
+		return err
+	}
+
+	conds := []string{}
+	args := []interface{}{}
+
+	for name, idx := range e.ObjectMaps[firing.RuleIndex] {
+		conds = append(conds, fmt.Sprintf("%s.ID = ?", name))
+		args = append(args, firing.Resources[idx])
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("%s AND %s", e.ruleMatches[firing.RuleIndex], strings.Join(conds, " AND ")), args...); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE instantiations SET scheduled = true, retry_at = ? WHERE ruleNum = ? AND json(resources) = json(?)", e.now().Add(rule.Every).UnixNano(), firing.RuleIndex, string(resources))
+
+	return err
+}
@@ -0,0 +1,107 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// When a resource expires and some rule matches ExpiredKind, the engine adds
+// an event of this kind holding the expired resource under "resource". The
+// events are marked as the engine's own and removed once the agenda has
+// drained; resources of this kind added by callers are left alone, and no
+// event is added over one of the same name.
+const ExpiredKind = "Expired"
+
+// SetTTL makes resources of a kind expire ttl after they were last added.
+// A zero ttl turns expiry off for resources of the kind added afterwards.
+func (e *Engine) SetTTL(kind string, ttl time.Duration) {
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	if ttl <= 0 {
+		delete(e.kindTTLs, kind)
+		return
+	}
+
+	e.kindTTLs[kind] = ttl
+}
+
+func (e *Engine) AddResourceWithTTL(resource string, ttl time.Duration) error {
+	return e.addResources([]string{resource}, ttl)
+}
+
+// setExpiry applies ttl, or the kind's TTL if ttl is zero, to a resource.
+func (e *Engine) setExpiry(ctx context.Context, tx *sql.Tx, kind, name, namespace string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = e.kindTTLs[kind]
+	}
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, "UPDATE resources SET EXPIRES_AT = ? WHERE KIND = ? AND NAME = ? AND NAMESPACE = ?", e.now().Add(ttl).UnixNano(), kind, name, namespace)
+
+	return err
+}
+
+func (e *Engine) matchesExpiry() bool {
+	for _, rule := range e.Rules {
+		for _, mv := range rule.Conditions.MatchVals {
+			if mv.Kind == ExpiredKind {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// expireResources deletes the resources whose time to live has passed,
+// which retracts their instantiations and the logical resources they
+// justify.
+func (e *Engine) expireResources(ctx context.Context, tx *sql.Tx) error {
+	now := e.now().UnixNano()
+
+	if e.matchesExpiry() {
+		_, err := tx.ExecContext(ctx, `INSERT INTO resources (KIND, NAME, NAMESPACE, DATA, EXPIRY_EVENT) SELECT ?, KIND || '.' || NAME, NAMESPACE, json_object('kind', ?, 'metadata', json_object('name', KIND || '.' || NAME, 'namespace', NAMESPACE), 'resource', json(DATA)), true FROM resources WHERE EXPIRES_AT <= ? AND NOT EXPIRY_EVENT ON CONFLICT DO UPDATE SET DATA = excluded.DATA WHERE EXPIRY_EVENT`, ExpiredKind, ExpiredKind, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM resources WHERE EXPIRES_AT <= ?", now)
+
+	return err
+}
+
+// agendaDrained removes the expiry events, except those that instantiations
+// parked for a retry or a timer still need.
+func (e *Engine) agendaDrained(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM resources WHERE EXPIRY_EVENT AND ID NOT IN (SELECT resource_ID FROM resource_instantiations)")
+
+	return err
+}
+
+// nextWakeup returns when Serve next has timed work to do: a parked
+// instantiation becoming ready or a resource expiring.
+func (e *Engine) nextWakeup(ctx context.Context) (_ time.Time, _ bool, err error) {
+	defer wrapStorageError(&err)
+
+	e.txLock.Lock()
+	defer e.txLock.Unlock()
+
+	var at sql.NullInt64
+
+	err = e.DB.QueryRowContext(ctx, "SELECT min(at) FROM (SELECT min(retry_at) AS at FROM instantiations WHERE active UNION ALL SELECT min(EXPIRES_AT) FROM resources)").Scan(&at)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if !at.Valid {
+		return time.Time{}, false, nil
+	}
+
+	return time.Unix(0, at.Int64), true, nil
+}